@@ -34,23 +34,40 @@ package main
  */
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
+	"os/exec"
+	"os/signal"
+	"reflect"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	mqtt "github.com/eclipse/paho.mqtt.golang" // Communication with MQTT broker
-	cache "github.com/patrickmn/go-cache"      // In memory structure to handle actuators and sensors
-	log "github.com/sirupsen/logrus"           // For log facility
-	conf "github.com/spf13/viper"              // Configuration handling
+	govaluate "github.com/Knetic/govaluate"                   // Expressions of the sensors transforms
+	mqtt "github.com/eclipse/paho.mqtt.golang"                // Communication with MQTT broker
+	"github.com/fsnotify/fsnotify"                            // Changes of the config file, watched by viper
+	cache "github.com/patrickmn/go-cache"                     // In memory structure to handle actuators and sensors
+	"github.com/prometheus/client_golang/prometheus"          // Metrics of the gateway
+	"github.com/prometheus/client_golang/prometheus/promhttp" // and their HTTP exposition
+	log "github.com/sirupsen/logrus"                          // For log facility
+	conf "github.com/spf13/viper"                             // Configuration handling
 
 	rfp "github.com/jacobsa/go-serial/serial" // Communication with rfplayer dongle
 )
@@ -151,9 +168,14 @@ const receivedProtocolDIGIMAX = 12 /* deprecated */
 const receivedProtocolTIC = 13
 const receivedProtocolFS20 = 14
 const receivedProtocolJAMMING = 15
+const receivedProtocolEDISIO = 16
 
 const regularIncomingRFBinaryUSBFrameInfosWordsNumber = 10
 
+const regularIncomingRFBinaryUSBFrameHeaderLength = 13 // Container header (5) and frame header (8), the infos words follow
+
+const payloadVersion = 24 // Version of the JSON payload format, see README.md
+
 const infosType0 = 0
 const infosType1 = 1
 const infosType2 = 2
@@ -187,6 +209,31 @@ type payloadTH struct {
 	H string
 }
 
+type batchItem struct {
+	Topic   string          `json:"topic"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+type commandAck struct {
+	Tc      string `json:"tc"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+type healthStatus struct {
+	SerialOK bool `json:"serial_ok"`
+	MqttOK   bool `json:"mqtt_ok"`
+	Ready    bool `json:"ready"`
+}
+
+type heartbeat struct {
+	Tc                  string `json:"tc"`
+	SerialOK            bool   `json:"serial_ok"`
+	LastFrameAgeSeconds int64  `json:"last_frame_age_seconds"` // -1 if no frame received yet
+	UptimeSeconds       int64  `json:"uptime_seconds"`
+	FramesReceived      uint64 `json:"frames_received"`
+}
+
 type messageContainerHeader struct {
 	sync1               byte
 	sync2               byte
@@ -350,26 +397,104 @@ var cmqtt mqtt.Client
 var cmqttOpts mqtt.ClientOptions
 
 var b bytes.Buffer
-var ch chan []byte
+var ch chan command
+
+/**
+ * Command queued for the dongle, with the name of the actuator to publish the result
+ */
+type command struct {
+	Name  string
+	Frame []byte
+}
 
 // var insecure *bool
 
 var rfpConfig rfp.OpenOptions
+var rfpOpen = rfp.Open // Opening of the serial port, replaced by a fake port in the tests
 var rfpPort io.ReadWriteCloser
+var rfpPortLock sync.Mutex // Held while rfpPort is read by emit or shutdown, or replaced by serialReopen
+var simFrames *simPort     // Source of the frames in simulation mode, nil with a dongle
 
 var errGlobal error
-var sensorsNameCache *cache.Cache       // Indexed by Id
-var sensorsTopicCache *cache.Cache      // Indexed by Id
-var actuatorsIDCache *cache.Cache       // Indexed by Name
-var actuatorsTopicCache *cache.Cache    // Indexed by Name
-var actuatorsCommandCache *cache.Cache  // Indexed by Name
-var actuatorsProtocolCache *cache.Cache // Indexed by Name
+var sensorsNameCache *cache.Cache         // Indexed by Id
+var sensorsTopicCache *cache.Cache        // Indexed by Id
+var sensorsFieldsCache *cache.Cache       // Indexed by Id
+var sensorsAliasesCache *cache.Cache      // Indexed by Id, topics the readings are also published on
+var sensorsTransformCache *cache.Cache    // Indexed by Id
+var sensorsProtocolCache *cache.Cache     // Indexed by Id
+var sensorsMaxStaleCache *cache.Cache     // Indexed by Id
+var sensorsTypeCache *cache.Cache         // Indexed by Id
+var sensorsDeviceClassCache *cache.Cache  // Indexed by Id
+var sensorsExpectedCache *cache.Cache     // Indexed by Id
+var sensorsPublishCache *cache.Cache      // Indexed by Topic, QoS and retain flag of the sensors overriding them
+var lastReadingsCache *cache.Cache        // Indexed by Id
+var actuatorsIDCache *cache.Cache         // Indexed by Name
+var actuatorsTopicCache *cache.Cache      // Indexed by Name
+var actuatorsCommandCache *cache.Cache    // Indexed by Name
+var actuatorsProtocolCache *cache.Cache   // Indexed by Name
+var actuatorsRefCache *cache.Cache        // Indexed by Name
+var actuatorsSourceDestCache *cache.Cache // Indexed by Name
+var pendingConfirmsCache *cache.Cache     // Indexed by Ref, actuators waiting for their state
+var lastPublishedCache *cache.Cache       // Indexed by Topic, last reading published
+var sensorsSeenCache *cache.Cache         // Indexed by Topic, sensors seen during the last brockermqtt.sensorexpire seconds
+var staleReadingsCache *cache.Cache       // Indexed by Id, last reading published of the sensors with a maximum staleness
+var ticCountersCache *cache.Cache         // Indexed by Ref and counter, last value and rollovers of the TIC counters
+var supervisionCache *cache.Cache         // Indexed by Ref, last supervision frames of the sensors
+var discoveryCache *cache.Cache           // Indexed by config topic, Home Assistant entities announced
 
 var iCompteur int
 
+var lowQualityFrames uint64 // Frames dropped by rfplayer.minquality or rfplayer.minrflevel
+
+var zeroQualityFrames uint64 // Frames dropped by rfplayer.dropzeroquality
+
+var unknownActuatorCommands uint64 // Commands received for an actuator not defined in config
+
+var commandTimes []time.Time // Time of the commands accepted during the last second
+var commandLock sync.Mutex
+
+var paused int32 // 1 while the gateway is paused by <topicroot>/admin/pause
+
+var testingActuators int32 // 1 while the actuators are exercised by <topicroot>/admin/testactuators
+
+var stopping int32 // 1 once SIGINT or SIGTERM is received, commands are no more accepted
+var emitting int32 // Number of commands queued or being written to the serial port
+
+var serialUp int32         // 1 while the serial port is open
+var mqttSubscribed int32   // 1 once the topics are subscribed on the current MQTT connection
+var mqttConnections uint64 // Connections to the broker since the start, the first one is not a reconnection
+var lastBytesTime int64    // Unix time of the last bytes read on the serial port
+var lastFrameTime int64    // Unix time of the last frame received
+var framesReceived uint64  // Frames received since the start, binary and ASCII
+var startTime = time.Now()
+
 var iWait2Send int
 
+var noSyncCount int     // Spool buffers discarded without 'ZI' since the last log
+var noSyncLog time.Time // Time of the last log of the discarded spool buffers
+
+var batch []batchItem // Readings waiting for the next batch publication
+var batchLock sync.Mutex
+
+var serialLost chan error // Errors on the serial port, handled by serialReopen
+
+var webhookQueue chan string // Readings waiting to be posted by the webhook sink
+
+var rfpFlags rfplayerFlags // Operational flags of the dongle, read from the STATUS responses
+var flagsLock sync.Mutex
+
+var configLock sync.RWMutex // Held while the config is reloaded, read by decode and the command handler
+
+var topicRootDeprecation sync.Once // Warn only once about brokermqtt.topicroot
+
+var initAcks chan string // ASCII responses of the dongle, read while sending the initialisation commands
+var initRunning int32    // 1 while the initialisation commands are sent
+var initDone int64       // Unix time (ns) of the end of the initialisation of the dongle, start of rfplayer.ignorecommandsonstartup
+
 var flagConfigFile string
+var flagDaemon bool
+
+var pidFile string // PID file written in daemon mode, removed on stop
 
 // Config : Internal struct type for config datas described in config.yml
 type Config struct {
@@ -399,22 +524,289 @@ type Config struct {
 		Level  string `yaml:"level"`
 	} `yaml:"log"`
 	Sensors []struct {
-		ID    string `yaml:"id"`
-		Name  string `yaml:"nom"`
-		Ref   string `yaml:"ref,omitempty"`
-		Topic string `yaml:"topic,omitempty"`
+		ID               string            `yaml:"id"`
+		Name             string            `yaml:"nom"`
+		Ref              string            `yaml:"ref,omitempty"`
+		Topic            string            `yaml:"topic,omitempty"`
+		Topics           []string          `yaml:"topics,omitempty"`
+		Type             string            `yaml:"type,omitempty"`
+		Protocol         string            `yaml:"protocol,omitempty"`
+		ExpectedProtocol string            `yaml:"expectedprotocol,omitempty"`
+		Fields           []string          `yaml:"fields,omitempty"`
+		Transform        map[string]string `yaml:"transform,omitempty"`
+		MaxStale         int               `yaml:"maxstale,omitempty"`
+		QoS              *int              `yaml:"qos,omitempty"`
+		Retain           *bool             `yaml:"retain,omitempty"`
+		Class            string            `yaml:"class,omitempty"`
+		DeviceClass      string            `yaml:"deviceclass,omitempty"`
 	} `yaml:"sensors"`
 	Actuators []struct {
-		ID       string `yaml:"id"`
-		Name     string `yaml:"name"`
-		Protocol string `yaml:"protocol"`
-		Topic    string `yaml:"topic"`
-		Command  string `yaml:"command"`
+		ID          string `yaml:"id"`
+		Name        string `yaml:"name"`
+		Protocol    string `yaml:"protocol"`
+		Topic       string `yaml:"topic"`
+		Command     string `yaml:"command"`
+		Ref         string `yaml:"ref,omitempty"`
+		ReportsBack bool   `yaml:"reportsback,omitempty"`
+		SourceDest  byte   `yaml:"sourcedest,omitempty"`
 	} `yaml:"actuators"`
+	Protocols struct {
+		Aliases             map[string]string   `yaml:"aliases"`
+		Fields              map[string][]string `yaml:"fields"`
+		ChaconDeviceTypes   map[string]string   `yaml:"chacondevicetypes"`
+		X2DShutterActions   map[string]string   `yaml:"x2dshutteractions"`
+		TICSignedSubtypes   []string            `yaml:"ticsignedsubtypes"`
+		X2DRelayStates      map[string]string   `yaml:"x2drelaystates"`
+		OregonTemp2Subtypes []string            `yaml:"oregontemp2subtypes"`
+	} `yaml:"protocols"`
 }
 
 var config Config
 
+/**
+ * Built-in device types of the CHACON subtypes (OFF, ON, BRIGHT, DIM, ALL_OFF, ALL_ON)
+ * Types defined in protocols.chacondevicetypes take precedence
+ */
+var defaultChaconDeviceTypes = map[string]string{
+	"0": "switch",
+	"1": "switch",
+	"2": "dimmer",
+	"3": "dimmer",
+	"4": "switch",
+	"5": "switch",
+}
+
+/**
+ * Built-in relay states of an X2D contactor by "<function>:<mode>", the ECO, COMFORT and STOP modes of the function 12
+ * States defined in protocols.x2drelaystates take precedence
+ */
+var defaultX2DRelayStates = map[string]string{
+	"12:0": "hc",
+	"12:3": "hp",
+	"12:4": "off",
+}
+
+/**
+ * Prometheus metrics, exposed on /metrics of the HTTP server with http.metrics
+ */
+var metricFramesReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "rfp2mqtt_frames_received_total",
+	Help: "Binary frames received from the dongle, by protocol",
+}, []string{"protocol"})
+
+var metricFramesDecoded = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "rfp2mqtt_frames_decoded_total",
+	Help: "Frames decoded into a reading",
+})
+
+var metricFramesRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "rfp2mqtt_frames_rejected_total",
+	Help: "Frames rejected, by reason : nosync (no ZI), short, quality",
+}, []string{"reason"})
+
+var metricMqttPublished = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "rfp2mqtt_mqtt_published_total",
+	Help: "MQTT messages published",
+})
+
+var metricCommandsReceived = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "rfp2mqtt_commands_received_total",
+	Help: "Commands received on home/action",
+})
+
+var metricReconnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "rfp2mqtt_reconnects_total",
+	Help: "Reconnections, by link : serial, mqtt",
+}, []string{"link"})
+
+var metricRFLevel = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "rfp2mqtt_rf_level_dbm",
+	Help: "RF level of the last frame of each sensor of the config",
+}, []string{"ref"})
+
+/**
+ * Names of the received protocols, for the metrics
+ */
+var receivedProtocolNames = map[byte]string{
+	receivedProtocolX10:     "x10",
+	receivedProtocolVISONIC: "visonic",
+	receivedProtocolBLYSS:   "blyss",
+	receivedProtocolCHACON:  "chacon",
+	receivedProtocolOREGON:  "oregon",
+	receivedProtocolDOMIA:   "domia",
+	receivedProtocolOWL:     "owl",
+	receivedProtocolX2D:     "x2d",
+	receivedProtocolRFY:     "rts",
+	receivedProtocolKD101:   "kd101",
+	receivedProtocolPARROT:  "parrot",
+	receivedProtocolDIGIMAX: "digimax",
+	receivedProtocolTIC:     "tic",
+	receivedProtocolFS20:    "fs20",
+	receivedProtocolJAMMING: "jamming",
+	receivedProtocolEDISIO:  "edisio",
+}
+
+/**
+ * Function that return the name of a received protocol for the metrics, its number if unknown
+ */
+func receivedProtocolName(protocol byte) string {
+	if name, found := receivedProtocolNames[protocol]; found {
+		return name
+	}
+
+	return strconv.Itoa(int(protocol))
+}
+
+/**
+ * Minimum length of the frames by infosType, headers included, to hold the infos words read by decode
+ */
+var infosTypeMinLength = map[byte]int{
+	infosType0:  19,
+	infosType1:  19,
+	infosType2:  21,
+	infosType3:  21,
+	infosType4:  25,
+	infosType5:  27,
+	infosType6:  25,
+	infosType7:  23,
+	infosType8:  33,
+	infosType9:  27,
+	infosType10: 27,
+	infosType11: 27,
+	infosType12: 25,
+	infosType13: 33,
+	infosType14: 21,
+	infosType15: 19,
+}
+
+/**
+ * Protocols of the actuators accepting a dim:<level> command
+ */
+var dimmableProtocols = map[string]bool{
+	"chacon": true,
+}
+
+/**
+ * Field of the readings, the source of the JSON schema published on <topicroot>/schema
+ * and of the fields ignored by brockermqtt.changeonly. The timestamp field is added with its configured name
+ */
+type readingField struct {
+	Name          string
+	Type          string // JSON schema type : string, integer or array of strings
+	Description   string
+	ChangeIgnored bool // Not taken into account to detect a change in brockermqtt.changeonly mode
+}
+
+var readingFields = []readingField{
+	{"v", "integer", "Version of the payload format", false},
+	{"n", "string", "Name of the sensor", false},
+	{"r", "string", "Id of the sensor (pp-nnnnnnnn)", false},
+	{"type", "string", "Type of the sensor, from the config", false},
+	{"st", "string", "Subtype", false},
+	{"srcdest", "string", "Source-dest byte of the frame", false},
+	{"protocol", "string", "Protocol label", false},
+	{"id_hex", "string", "Device ID bytes in hexadecimal, LSB first", false},
+	{"hash", "string", "CRC32 of the reading, without the timestamp and RF metrics", false},
+	{"q", "string", "Qualifier", false},
+	{"ftamper", "string", "Tamper flag", false},
+	{"falarm", "string", "Alarm flag", false},
+	{"fanomaly", "string", "Anomaly flag", false},
+	{"flowbatt", "string", "Low battery flag", false},
+	{"falive", "string", "Supervision frame flag", false},
+	{"ftestassoc", "string", "Test/association flag", false},
+	{"fdomestic", "string", "Domestic frame flag", false},
+	{"bits", "array", "The 16 bits of the qualifier, LSB first (brockermqtt.allqualifierbits)", false},
+	{"devicetype", "string", "CHACON device type", false},
+	{"shutter_action", "string", "X2D shutter action, from protocols.x2dshutteractions", false},
+	{"relay_state", "string", "X2D contactor relay state (hc, hp, off)", false},
+	{"t", "string", "Temperature (°C)", false},
+	{"h", "string", "Humidity (%)", false},
+	{"temp2_c", "string", "Temperature of the second probe (°C)", false},
+	{"slot", "string", "Slot of the learned code (PARROT)", false},
+	{"band", "string", "Band of the learned code : 433, 868 (MHz) or unknown", false},
+	{"p", "string", "Pressure (hPa) or power (W)", false},
+	{"s", "string", "Wind speed (0.1 m/s) or jamming subtype", false},
+	{"d", "string", "Wind direction (°)", false},
+	{"l", "string", "UV index", false},
+	{"e", "string", "Energy (Wh)", false},
+	{"pi1", "string", "Power of input 1 (W)", false},
+	{"pi2", "string", "Power of input 2 (W)", false},
+	{"pi3", "string", "Power of input 3 (W)", false},
+	{"channel", "string", "OWL channel", false},
+	{"tra", "string", "Total rain (0.1 mm)", false},
+	{"ra", "string", "Rain rate (0.01 mm/h)", false},
+	{"ct", "string", "TIC contract type", false},
+	{"cnt1", "string", "TIC counter 1", false},
+	{"cnt2", "string", "TIC counter 2", false},
+	{"cnt1_total", "string", "TIC counter 1, monotonic across the 32 bits rollovers", false},
+	{"cnt2_total", "string", "TIC counter 2, monotonic across the 32 bits rollovers", false},
+	{"rollover", "string", "A TIC counter wrapped in this reading (0/1)", false},
+	{"supervision_interval_s", "string", "Rolling interval between the supervision frames (s)", true}, // Changes with each supervision frame
+	{"ap", "string", "TIC apparent power", false},
+	{"severity", "string", "Jamming severity (low, medium, high)", false},
+	{"rflevel", "string", "RF level of the frame (dBm)", true}, // The RF metrics change with each frame
+	{"floornoise", "string", "Floor noise when the frame was received (dBm)", true},
+	{"rfquality", "string", "RF quality of the frame (1 to 10)", true},
+	{"infostype", "string", "infosType of a frame published raw, without decoder", false},
+	{"frametype", "string", "Frame type of a frame published raw (0 regular, 1 RFLink)", false},
+	{"raw", "string", "Bytes of a frame published raw, in hexadecimal", false},
+}
+
+/**
+ * Field of the JSON schema of the readings
+ */
+type schemaField struct {
+	Type        string       `json:"type"`
+	Description string       `json:"description"`
+	Items       *schemaField `json:"items,omitempty"`
+}
+
+var payloadSchemaFields = schemaFields()
+
+/**
+ * Function that return the fields of the JSON schema, from readingFields
+ */
+func schemaFields() map[string]schemaField {
+	fields := map[string]schemaField{}
+	for _, f := range readingFields {
+		field := schemaField{Type: f.Type, Description: f.Description}
+		if f.Type == "array" {
+			field.Items = &schemaField{Type: "string"}
+		}
+		fields[f.Name] = field
+	}
+
+	return fields
+}
+
+/**
+ * Fields not taken into account to detect a change in brockermqtt.changeonly mode, besides the timestamp
+ */
+var changeIgnoredFields = ignoredFields()
+
+/**
+ * Function that return the fields ignored by brockermqtt.changeonly, from readingFields
+ */
+func ignoredFields() map[string]bool {
+	fields := map[string]bool{}
+	for _, f := range readingFields {
+		if f.ChangeIgnored {
+			fields[f.Name] = true
+		}
+	}
+
+	return fields
+}
+
+/**
+ * Built-in aliases of the protocol names used in the actuators config
+ * Aliases defined in protocols.aliases take precedence
+ */
+var defaultProtocolAliases = map[string]string{
+	"dio": "chacon",
+	"rts": "somfyrts",
+}
+
 /**
  * Compute an unsigned 32 bits integer from unsigned 16 bits integer
  */
@@ -458,197 +850,890 @@ func testBit(bpar byte, npar int) string {
 }
 
 /**
- * Decode a message from RFPlayer
+ * Function that return the 16 bits of a qualifier, bit 0 first, as decoded by testBit
  */
-func decode(l int, m []byte) {
-	var jsonString string
+func qualifierBits(m []byte) []string {
+	bits := make([]string, 16)
+	for i := 0; i < 16; i++ {
+		bits[i] = testBit(m[i/8], i%8)
+	}
+	return bits
+}
 
-	timecodeString := time.Now().Format(time.RFC3339)
+/**
+ * Function that return the device type of a CHACON frame from its subtype
+ */
+func chaconDeviceType(subType uint16) string {
+	key := strconv.FormatUint(uint64(subType), 10)
 
-	sensor := Sensor{}
+	if deviceType, found := config.Protocols.ChaconDeviceTypes[key]; found {
+		return deviceType
+	}
+	if deviceType, found := defaultChaconDeviceTypes[key]; found {
+		return deviceType
+	}
 
-	log.Debug("RFLevel=", int8(m[8]), ", FloorNoise=", int8(m[9]), ", RFQuality=", m[10], ", Protocol=", m[11], ", InfosType=", m[12])
+	return "unknown"
+}
 
-	switch m[12] {
-	case infosType0:
-		log.Debug(", X10, DOMIA_LITE, PARROT")
-		log.Debug(", SubType=", binary.LittleEndian.Uint16(m[13:]))
-		log.Debug(", Id=", binary.LittleEndian.Uint32(m[15:]))
+/**
+ * Function that return the shutter action of an X2D shutter frame from its function word
+ * The mapping comes from protocols.x2dshutteractions, as the layout of the frame marks this word reserved
+ */
+func x2dShutterAction(function uint16) (string, bool) {
+	action, found := config.Protocols.X2DShutterActions[strconv.FormatUint(uint64(function), 10)]
 
-		sensor.Ref = strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[13:])), 10)
-		sensor.Protocol = "X10"
-		sensor.SubType = strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[13:])), 10)
-		sensor.Name = sensorName(sensor.Ref)
-		sensor.Topic = sensorTopic(sensor.Ref)
-		if sensor.Topic == "NULL" {
-			sensor.Topic = conf.GetString("brokermqtt.topicroot") + "/" + sensor.Ref + "/x10"
-		}
-		log.Debug(", topic=", sensor.Topic)
+	return action, found
+}
 
-		topicSplit := strings.Split(sensor.Topic, "/")
+/**
+ * Function that return the band of a received frame from the dataFlag of the header, 0 for 433 MHz and 1 for 868 MHz
+ */
+func rfBand(dataFlag byte) string {
+	switch dataFlag {
+	case 0:
+		return "433"
+	case 1:
+		return "868"
+	}
 
-		jsonString = "{ \"tc\": \"" + timecodeString
-		jsonString = jsonString + "\" , \"n\": \"" + topicSplit[1]
-		jsonString = jsonString + "\" , \"r\": \"" + sensor.Ref
-		jsonString = jsonString + "\" , \"st\": \"" + sensor.SubType
-		jsonString = jsonString + "\" }"
+	return "unknown"
+}
 
-	case infosType1:
-		log.Debug(", CHACON ...")
-		log.Debug(", SubType=", binary.LittleEndian.Uint16(m[13:]))
-		log.Debug(", Id=", binary.LittleEndian.Uint32(m[15:]))
+/**
+ * Function that return the topic of a sensor absent from the config, <topicroot>/<id>/<suffix>
+ * With brockermqtt.bandtopics, the band of the frame comes first : <topicroot>/<band>/<id>/<suffix>
+ */
+func fallbackTopic(ref string, suffix string, dataFlag byte) string {
+	if conf.GetBool("brockermqtt.bandtopics") {
+		return brokerTopicRoot() + "/" + rfBand(dataFlag) + "/" + ref + "/" + suffix
+	}
 
-		sensor.Ref = "1-" + strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[15:])), 10)
-		sensor.Protocol = "CHACON"
-		sensor.SubType = strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[13:])), 10)
-		sensor.Name = sensorName(sensor.Ref)
-		sensor.Topic = sensorTopic(sensor.Ref)
-		if sensor.Topic == "NULL" {
-			sensor.Topic = conf.GetString("brokermqtt.topicroot") + "/" + sensor.Ref + "/chacon"
-		}
-		log.Debug(", topic=", sensor.Topic)
+	return brokerTopicRoot() + "/" + ref + "/" + suffix
+}
 
-		topicSplit := strings.Split(sensor.Topic, "/")
+/**
+ * Last value and accumulated rollovers of a TIC counter
+ */
+type ticCounter struct {
+	Last      uint32
+	Offset    uint64
+	Wrapped   bool   // A rollover is waiting for the confirmation of the next frame
+	Candidate uint32 // First value after this rollover
+}
 
-		jsonString = "{ \"tc\": \"" + timecodeString
-		jsonString = jsonString + "\" , \"n\": \"" + topicSplit[1]
-		jsonString = jsonString + "\" , \"r\": \"" + sensor.Ref
-		jsonString = jsonString + "\" , \"st\": \"" + sensor.SubType
-		jsonString = jsonString + "\" }"
+/**
+ * Function that return the monotonic total of a 32 bits TIC counter, and if it has just wrapped
+ * - A decrease from the upper half of the range to the lower half is a rollover if the next frame confirms it,
+ *   with a value still in the lower half and not below : 2^32 is then added to the following values.
+ *   Until then the last total is returned, a single corrupted frame is not counted
+ * - Another decrease (meter replaced or reset) is only logged
+ * The totals are saved to brockermqtt.ticcountersfile on each rollover, if set
+ */
+func ticCounterTotal(ref string, counter string, v uint32) (uint64, bool) {
+	key := ref + "/" + counter
+	c := ticCounter{Last: v}
+	rollover := false
+
+	if foo, found := ticCountersCache.Get(key); found {
+		c = foo.(ticCounter)
+		switch {
+		case c.Wrapped && v < 1<<31 && v >= c.Candidate:
+			c.Offset += 1 << 32
+			c.Wrapped = false
+			rollover = true
+			log.Info("TIC counter ", counter, " of ", ref, " wrapped, from ", c.Last, " to ", c.Candidate)
+		case c.Last >= 1<<31 && v < 1<<31:
+			c.Wrapped = true
+			c.Candidate = v
+			ticCountersCache.Set(key, c, cache.NoExpiration)
+			log.Debug("TIC counter ", counter, " of ", ref, " from ", c.Last, " to ", v, ", rollover to be confirmed")
+			return c.Offset + uint64(c.Last), false
+		case v < c.Last:
+			c.Wrapped = false
+			log.Warn("TIC counter ", counter, " of ", ref, " decreased from ", c.Last, " to ", v, ", meter reset ?")
+		default:
+			c.Wrapped = false // Back above the last value, the frame in the lower half was corrupted
+		}
+		c.Last = v
+	}
+	ticCountersCache.Set(key, c, cache.NoExpiration)
+	if rollover {
+		saveTICCounters()
+	}
 
-	case infosType2:
-		log.Debug(", VISONIC")
-		log.Debug(", SubType=", binary.LittleEndian.Uint16(m[13:]))
-		log.Debug(", Id=", binary.LittleEndian.Uint32(m[15:]))
-		log.Debug(", qualifier=", binary.LittleEndian.Uint16(m[19:]))
+	return c.Offset + uint64(v), rollover
+}
 
-		sensor.Ref = "2-" + strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[15:])), 10)
-		sensor.Protocol = "VISONIC"
-		sensor.SubType = strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[13:])), 10)
-		sensor.Name = sensorName(sensor.Ref)
-		sensor.Topic = sensorTopic(sensor.Ref)
-		if sensor.Topic == "NULL" {
-			sensor.Topic = conf.GetString("brokermqtt.topicroot") + "/" + sensor.Ref + "/visonic"
-		}
-		log.Debug(", topic=", sensor.Topic)
+/**
+ * Function that save the TIC counters to brockermqtt.ticcountersfile, for their totals to survive a restart
+ */
+func saveTICCounters() {
+	path := conf.GetString("brockermqtt.ticcountersfile")
+	if path == "" || ticCountersCache == nil {
+		return
+	}
 
-		qualifierString := strconv.FormatUint(uint64(binary.LittleEndian.Uint16(m[19:])), 10)
+	if err := ticCountersCache.SaveFile(path); err != nil {
+		log.Error("Unable to save the TIC counters to ", path, ": ", err)
+	}
+}
 
-		topicSplit := strings.Split(sensor.Topic, "/")
+/**
+ * Function that load the TIC counters saved to brockermqtt.ticcountersfile, if set
+ */
+func loadTICCounters() {
+	path := conf.GetString("brockermqtt.ticcountersfile")
+	if path == "" {
+		return
+	}
 
-		jsonString = "{ \"tc\": \"" + timecodeString
-		jsonString = jsonString + "\" , \"n\": \"" + topicSplit[1]
-		jsonString = jsonString + "\" , \"r\": \"" + sensor.Ref
-		jsonString = jsonString + "\" , \"q\": \"" + qualifierString
-		jsonString = jsonString + "\" , \"ftamper\": \"" + testBit(m[19], 0)  // tamper flag
-		jsonString = jsonString + "\" , \"falarm\": \"" + testBit(m[19], 1)   // alarm flag
-		jsonString = jsonString + "\" , \"flowbatt\": \"" + testBit(m[19], 2) // low batt flag
-		jsonString = jsonString + "\" , \"falive\": \"" + testBit(m[19], 3)   // supervisor message flag
-		jsonString = jsonString + "\" , \"st\": \"" + sensor.SubType
-		jsonString = jsonString + "\" }"
+	gob.Register(ticCounter{}) // Type of the items of the file
+	if err := ticCountersCache.LoadFile(path); err != nil && !os.IsNotExist(err) {
+		log.Error("Unable to load the TIC counters from ", path, ": ", err)
+	}
+}
 
-	case infosType3:
-		log.Debug(", RTS")
-		log.Debug(", SubType=", binary.LittleEndian.Uint16(m[13:]))
-		log.Debug(", Id=", binary.LittleEndian.Uint32(m[15:]))
-		log.Debug(", qualifier=", binary.LittleEndian.Uint16(m[19:]))
+const supervisionIntervals = 8 // Number of intervals averaged in supervision_interval_s
 
-		sensor.Ref = "3-" + strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[15:])), 10)
-		sensor.Protocol = "RTS"
-		sensor.SubType = strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[13:])), 10)
-		sensor.Name = sensorName(sensor.Ref)
-		sensor.Topic = sensorTopic(sensor.Ref)
-		if sensor.Topic == "NULL" {
-			sensor.Topic = conf.GetString("brokermqtt.topicroot") + "/" + sensor.Ref + "/rts"
+/**
+ * Last supervision frame of a sensor and the intervals observed before it
+ */
+type supervision struct {
+	Last      time.Time
+	Intervals []float64
+}
+
+/**
+ * Function that return the rolling interval in seconds between the supervision frames of a sensor
+ * The interval is the mean of the last supervisionIntervals ones, false for the first frame seen
+ */
+func supervisionInterval(ref string, now time.Time) (float64, bool) {
+	s := supervision{Last: now}
+	if foo, found := supervisionCache.Get(ref); found {
+		s = foo.(supervision)
+		s.Intervals = append(s.Intervals, now.Sub(s.Last).Seconds())
+		if len(s.Intervals) > supervisionIntervals {
+			s.Intervals = s.Intervals[len(s.Intervals)-supervisionIntervals:]
 		}
-		log.Debug(", topic=", sensor.Topic)
+		s.Last = now
+	}
+	supervisionCache.Set(ref, s, cache.NoExpiration)
 
-		qualifierString := strconv.FormatUint(uint64(binary.LittleEndian.Uint16(m[19:])), 10)
+	if len(s.Intervals) == 0 {
+		return 0, false
+	}
 
-		topicSplit := strings.Split(sensor.Topic, "/")
+	sum := 0.0
+	for _, i := range s.Intervals {
+		sum += i
+	}
 
-		jsonString = "{ \"tc\": \"" + timecodeString
-		jsonString = jsonString + "\" , \"n\": \"" + topicSplit[1]
-		jsonString = jsonString + "\" , \"r\": \"" + sensor.Ref
-		jsonString = jsonString + "\" , \"q\": \"" + qualifierString
-		jsonString = jsonString + "\" , \"st\": \"" + sensor.SubType
-		jsonString = jsonString + "\" }"
+	return sum / float64(len(s.Intervals)), true
+}
 
-	case infosType4:
-		log.Debug(", OREGON Thermo/Hygro")
-		log.Debug(", SubType=", binary.LittleEndian.Uint16(m[13:]))
-		log.Debug(", idPHY=", binary.LittleEndian.Uint16(m[15:]))
-		log.Debug(", idChannel=", binary.LittleEndian.Uint16(m[17:]))
-		log.Debug(", qualifier=", binary.LittleEndian.Uint16(m[19:]))
-		log.Debug(", temp=", int16(binary.LittleEndian.Uint16(m[21:])))
-		log.Debug(", hygro=", binary.LittleEndian.Uint16(m[23:]))
+/**
+ * Function that return the 40 bits ID of a TIC frame : idLsb, idMsb and idMsb2 in the high byte of the qualifier
+ */
+func ticID(m []byte) uint64 {
+	return uint64(binary.LittleEndian.Uint32(m[15:])) | uint64(m[20])<<32
+}
 
-		sensor.Ref = "4-" + strconv.FormatUint(uint64(touint32(binary.LittleEndian.Uint16(m[15:]), binary.LittleEndian.Uint16(m[17:]))), 10)
-		sensor.Protocol = "OREGON"
-		sensor.SubType = strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[13:])), 10)
-		sensor.Name = sensorName(sensor.Ref)
-		sensor.Topic = sensorTopic(sensor.Ref)
-		if sensor.Topic == "NULL" {
-			sensor.Topic = conf.GetString("brokermqtt.topicroot") + "/" + sensor.Ref + "/th"
+/**
+ * Function that tell if an OREGON thermo/hygro subtype carries a second temperature instead of the humidity
+ * As for the dual probe pool thermometers, listed in protocols.oregontemp2subtypes
+ */
+func oregonTemp2(subType uint16) bool {
+	key := strconv.FormatUint(uint64(subType), 10)
+
+	for _, dual := range config.Protocols.OregonTemp2Subtypes {
+		if dual == key {
+			return true
 		}
-		log.Debug(", topic=", sensor.Topic)
+	}
 
-		tempString := strconv.FormatFloat(float64(uint64(binary.LittleEndian.Uint16(m[21:])))*0.1, 'f', 1, 64)
-		humiString := strconv.FormatUint(uint64(binary.LittleEndian.Uint16(m[23:])), 10)
+	return false
+}
 
-		topicSplit := strings.Split(sensor.Topic, "/")
+/**
+ * Function that tell if the apparent power of a TIC subtype is signed
+ * Meters of production or injection report a negative apparent power on export
+ */
+func ticSigned(subType uint16) bool {
+	key := strconv.FormatUint(uint64(subType), 10)
 
-		jsonString = "{ \"tc\": \"" + timecodeString
-		jsonString = jsonString + "\" , \"n\": \"" + topicSplit[1]
-		jsonString = jsonString + "\" , \"r\": \"" + sensor.Ref
-		jsonString = jsonString + "\" , \"t\": \"" + tempString
-		jsonString = jsonString + "\" , \"h\": \"" + humiString
-		jsonString = jsonString + "\" , \"flowbatt\": \"" + testBit(m[19], 0) // low batt flag
-		jsonString = jsonString + "\" , \"st\": \"" + sensor.SubType
-		jsonString = jsonString + "\" }"
-		//		} else {
-		//			log.Info("RFLevel=", int8(m[8]), ", FloorNoise=", int8(m[9]), ", RFQuality=", m[10], ", Protocol=", m[11], ", InfosType=", m[12])
-		//			log.Info("Topic problem : topic=>", sensor.Topic, "<, len=", len(topicSplit), ", Sensor Ref:>", sensor.Ref, "<")
-		//		}
+	for _, signed := range config.Protocols.TICSignedSubtypes {
+		if signed == key {
+			return true
+		}
+	}
 
-	case infosType5:
-		log.Debug(", OREGON Atmo pressure")
-		log.Debug(", SubType=", binary.LittleEndian.Uint16(m[13:]))
-		log.Debug(", idPHY=", binary.LittleEndian.Uint16(m[15:]))
-		log.Debug(", idChannel=", binary.LittleEndian.Uint16(m[17:]))
-		log.Debug(", qualifier=", binary.LittleEndian.Uint16(m[19:]))
-		log.Debug(", temp=", int16(binary.LittleEndian.Uint16(m[21:])))
-		log.Debug(", hygro=", binary.LittleEndian.Uint16(m[23:]))
-		log.Debug(", pressure=", binary.LittleEndian.Uint16(m[25:]))
+	return false
+}
 
-		sensor.Ref = "5-" + strconv.FormatUint(uint64(touint32(binary.LittleEndian.Uint16(m[15:]), binary.LittleEndian.Uint16(m[17:]))), 10)
-		sensor.Protocol = "OREGON"
-		sensor.SubType = strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[13:])), 10)
-		sensor.Name = sensorName(sensor.Ref)
-		sensor.Topic = sensorTopic(sensor.Ref)
-		if sensor.Topic == "NULL" {
-			sensor.Topic = conf.GetString("brokermqtt.topicroot") + "/" + sensor.Ref + "/thpa"
-		}
-		log.Debug(", topic=", sensor.Topic)
+/**
+ * Function that format a 16 bits TIC value, signed or not
+ */
+func ticValue(v uint16, signed bool) string {
+	if signed {
+		return strconv.Itoa(int(int16(v)))
+	}
+	return strconv.FormatUint(uint64(v), 10)
+}
 
-		tempString := strconv.FormatUint(uint64(binary.LittleEndian.Uint16(m[21:])), 10)
-		humiString := strconv.FormatUint(uint64(binary.LittleEndian.Uint16(m[23:])), 10)
-		pressureString := strconv.FormatUint(uint64(binary.LittleEndian.Uint16(m[25:])), 10)
+/**
+ * Function that return the relay state of an X2D contactor (hc, hp, off) from the function and mode words
+ * The mapping of protocols.x2drelaystates, indexed by "<function>:<mode>", completes the built-in one
+ */
+func x2dRelayState(function uint16, mode uint16) (string, bool) {
+	key := strconv.FormatUint(uint64(function), 10) + ":" + strconv.FormatUint(uint64(mode), 10)
 
-		topicSplit := strings.Split(sensor.Topic, "/")
+	if state, found := config.Protocols.X2DRelayStates[key]; found {
+		return state, true
+	}
+	state, found := defaultX2DRelayStates[key]
 
-		jsonString = "{ \"tc\": \"" + timecodeString
-		jsonString = jsonString + "\" , \"n\": \"" + topicSplit[1]
-		jsonString = jsonString + "\" , \"r\": \"" + sensor.Ref
-		jsonString = jsonString + "\" , \"t\": \"" + tempString
-		jsonString = jsonString + "\" , \"h\": \"" + humiString
-		jsonString = jsonString + "\" , \"p\": \"" + pressureString
-		jsonString = jsonString + "\" , \"flowbatt\": \"" + testBit(m[19], 0) // low batt flag
-		jsonString = jsonString + "\" , \"st\": \"" + sensor.SubType
-		jsonString = jsonString + "\" }"
+	return state, found
+}
 
-	case infosType6:
-		log.Debug(", OREGON Wind")
+/**
+ * Function that format a temperature in 1/10 of degree Celsius, coded as a two's complement int16
+ */
+func temperature(v uint16) string {
+	return strconv.FormatFloat(float64(int16(v))*0.1, 'f', 1, 64)
+}
+
+/**
+ * Function that set the humidity field after checking its range (0-100%)
+ * An out of range value comes from a corrupted frame, handled as set in rfplayer.invalidhumidity :
+ *
+ * - field : the humidity is not published
+ * - frame : the whole frame is dropped, false is returned
+ * - clamp : the humidity is published as 100
+ */
+func setHumidity(sensor Sensor, humidity uint16, fields map[string]interface{}) bool {
+	if humidity <= 100 {
+		fields["h"] = strconv.FormatUint(uint64(humidity), 10)
+		return true
+	}
+
+	log.Warn("Humidity out of range for ", sensor.Ref, " : ", humidity, "%")
+
+	switch conf.GetString("rfplayer.invalidhumidity") {
+	case "frame":
+		return false
+	case "clamp":
+		fields["h"] = "100"
+	}
+
+	return true
+}
+
+/**
+ * Function that return the severity of a jamming (low, medium or high) from its RF level
+ */
+func jammingSeverity(rfLevel int8) string {
+	switch {
+	case int(rfLevel) >= conf.GetInt("rfplayer.jamminghighlevel"):
+		return "high"
+	case int(rfLevel) >= conf.GetInt("rfplayer.jammingmediumlevel"):
+		return "medium"
+	default:
+		return "low"
+	}
+}
+
+/**
+ * Function that apply the transforms of the sensor to the decoded fields
+ * The numeric fields are given to the expressions as numbers, a failing transform is skipped
+ */
+func transformFields(sensor Sensor, fields map[string]interface{}) {
+	transforms := sensorTransforms(sensor.Ref)
+	if len(transforms) == 0 {
+		return
+	}
+
+	parameters := map[string]interface{}{}
+	for k, v := range fields {
+		parameters[k] = v
+		if str, ok := v.(string); ok {
+			if f, err := strconv.ParseFloat(str, 64); err == nil {
+				parameters[k] = f
+			}
+		}
+	}
+
+	for field, e := range transforms {
+		result, err := e.Evaluate(parameters)
+		if err != nil {
+			log.Warn("Transform of field ", field, " failed for sensor ", sensor.Ref, " : ", err)
+			continue
+		}
+		fields[field] = result
+	}
+}
+
+/**
+ * Function that remove the fields not in the allowlist of the sensor, or else of its protocol
+ * No allowlist means all fields are published
+ */
+func filterFields(sensor Sensor, fields map[string]interface{}) {
+	allowed := sensorFields(sensor.Ref)
+	if allowed == nil {
+		allowed = config.Protocols.Fields[strings.ToLower(sensor.Protocol)]
+	}
+	if len(allowed) == 0 {
+		return
+	}
+
+	for k := range fields {
+		keep := false
+		for _, a := range allowed {
+			if k == a {
+				keep = true
+				break
+			}
+		}
+		if !keep {
+			delete(fields, k)
+		}
+	}
+}
+
+/**
+ * Function that return the root of the topics, brockermqtt.topicroot
+ * The spelling brokermqtt.topicroot, once read by the decoding, is still accepted if it is the only one set
+ */
+func brokerTopicRoot() string {
+	if conf.IsSet("brokermqtt.topicroot") && !conf.InConfig("brockermqtt.topicroot") {
+		topicRootDeprecation.Do(func() {
+			log.Warn("brokermqtt.topicroot is deprecated, use brockermqtt.topicroot")
+		})
+		return conf.GetString("brokermqtt.topicroot")
+	}
+
+	return conf.GetString("brockermqtt.topicroot")
+}
+
+/**
+ * Function that return the topic t in the namespace of the gateway, <gatewayprefix>/t
+ * With several gateways on one broker, each one lives under its own brockermqtt.gatewayprefix
+ */
+func gatewayTopic(t string) string {
+	if prefix := conf.GetString("brockermqtt.gatewayprefix"); prefix != "" {
+		return prefix + "/" + t
+	}
+
+	return t
+}
+
+/**
+ * Function that return the name published in the n field for a topic : its second segment,
+ * or the whole topic if it has no hierarchy (topic "salon")
+ */
+func topicName(t string) string {
+	if topicSplit := strings.Split(t, "/"); len(topicSplit) > 1 {
+		return topicSplit[1]
+	}
+
+	return t
+}
+
+/**
+ * ASCII transliteration of the accented characters, for brockermqtt.asciitopics
+ */
+var asciiTransliterations = map[rune]string{
+	'à': "a", 'â': "a", 'ä': "a", 'á': "a", 'ã': "a", 'å': "a",
+	'À': "A", 'Â': "A", 'Ä': "A", 'Á': "A", 'Ã': "A", 'Å': "A",
+	'é': "e", 'è': "e", 'ê': "e", 'ë': "e",
+	'É': "E", 'È': "E", 'Ê': "E", 'Ë': "E",
+	'î': "i", 'ï': "i", 'í': "i", 'ì': "i",
+	'Î': "I", 'Ï': "I", 'Í': "I", 'Ì': "I",
+	'ô': "o", 'ö': "o", 'ó': "o", 'ò': "o", 'õ': "o", 'ø': "o",
+	'Ô': "O", 'Ö': "O", 'Ó': "O", 'Ò': "O", 'Õ': "O", 'Ø': "O",
+	'ù': "u", 'û': "u", 'ü': "u", 'ú': "u",
+	'Ù': "U", 'Û': "U", 'Ü': "U", 'Ú': "U",
+	'ç': "c", 'Ç': "C", 'ñ': "n", 'Ñ': "N", 'ÿ': "y", 'ý': "y", 'Ý': "Y",
+	'œ': "oe", 'Œ': "OE", 'æ': "ae", 'Æ': "AE", 'ß': "ss",
+}
+
+/**
+ * Function that transliterate the accented characters of a topic to ASCII (é -> e)
+ * The other non ASCII characters are replaced by _
+ */
+func asciiTopic(t string) string {
+	var b strings.Builder
+
+	for _, c := range t {
+		switch {
+		case c < 0x80:
+			b.WriteRune(c)
+		case asciiTransliterations[c] != "":
+			b.WriteString(asciiTransliterations[c])
+		default:
+			b.WriteByte('_')
+		}
+	}
+
+	return b.String()
+}
+
+/**
+ * Function that return the name of the timestamp field of the readings
+ */
+func timeField() string {
+	return conf.GetString("brockermqtt.timefield")
+}
+
+/**
+ * Function that build the JSON schema of the readings
+ */
+func payloadSchema() map[string]interface{} {
+	properties := map[string]interface{}{}
+	for name, field := range payloadSchemaFields {
+		properties[name] = field
+	}
+	properties[timeField()] = map[string]string{"type": "string", "format": "date-time", "description": "Reception time"}
+
+	return map[string]interface{}{
+		"$schema":    "http://json-schema.org/draft-07/schema#",
+		"title":      "rfp2mqtt reading",
+		"type":       "object",
+		"properties": properties,
+		"required":   []string{"v"},
+	}
+}
+
+/**
+ * Function that publish the JSON schema of the readings, retained, on <topicroot>/schema
+ */
+func publishSchema() {
+	schema, err := json.Marshal(payloadSchema())
+	if err != nil {
+		log.Error("Unable to build JSON schema: ", err)
+		return
+	}
+
+	publishMessage(brokerTopicRoot()+"/schema", 2, true, string(schema))
+}
+
+/**
+ * Function that check a reading against the JSON schema and log the differences
+ */
+func validateReading(ref string, fields map[string]interface{}) {
+	if _, found := fields["v"]; !found {
+		log.Warn("[SCHEMA] Reading of ", ref, " without field v")
+	}
+
+	for k, v := range fields {
+		expected := "string"
+		if field, found := payloadSchemaFields[k]; found {
+			expected = field.Type
+		} else if k != timeField() {
+			log.Warn("[SCHEMA] Reading of ", ref, " has field ", k, " not described in schema")
+			continue
+		}
+
+		switch v.(type) {
+		case string:
+			if expected != "string" {
+				log.Warn("[SCHEMA] Reading of ", ref, " has field ", k, " of type string instead of ", expected)
+			}
+		case int:
+			if expected != "integer" {
+				log.Warn("[SCHEMA] Reading of ", ref, " has field ", k, " of type integer instead of ", expected)
+			}
+		case []string:
+			if expected != "array" {
+				log.Warn("[SCHEMA] Reading of ", ref, " has field ", k, " of type array instead of ", expected)
+			}
+		default:
+			log.Warn("[SCHEMA] Reading of ", ref, " has field ", k, " of unexpected type ", reflect.TypeOf(v))
+		}
+	}
+}
+
+/**
+ * Function that compare a reading to the last one of the same sensor and keep it for the next call
+ *
+ * - Only fields of brockermqtt.changefields are compared if set
+ * - Otherwise all fields but the ignored ones (timestamp) are compared
+ */
+func readingChanged(ref string, fields map[string]interface{}) bool {
+	previous, found := lastReadingsCache.Get(ref)
+
+	/**
+	 * Keep a copy, the fields are completed after the comparison (hash) and would never match the next reading
+	 */
+	kept := make(map[string]interface{}, len(fields))
+	for k, v := range fields {
+		kept[k] = v
+	}
+	lastReadingsCache.Set(ref, kept, cache.NoExpiration)
+	if !found {
+		return true
+	}
+	last := previous.(map[string]interface{})
+
+	meaningful := conf.GetStringSlice("brockermqtt.changefields")
+	if len(meaningful) == 0 {
+		for k := range fields {
+			meaningful = append(meaningful, k)
+		}
+		for k := range last {
+			meaningful = append(meaningful, k)
+		}
+	}
+
+	for _, k := range meaningful {
+		if changeIgnoredFields[k] || k == timeField() {
+			continue
+		}
+		if !reflect.DeepEqual(fields[k], last[k]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+/**
+ * Function that return the CRC32 in hexadecimal of a reading, for the consumers to detect duplicates and corruption
+ * The fields ignored by brockermqtt.changeonly and the timestamp are left out, the keys are sorted by json.Marshal
+ */
+func readingHash(fields map[string]interface{}) string {
+	canonical := map[string]interface{}{}
+	for k, v := range fields {
+		if changeIgnoredFields[k] || k == timeField() || k == "hash" {
+			continue
+		}
+		canonical[k] = v
+	}
+
+	payload, err := json.Marshal(canonical)
+	if err != nil {
+		return ""
+	}
+
+	return fmt.Sprintf("%08x", crc32.ChecksumIEEE(payload))
+}
+
+/**
+ * Reading decoded from a frame, ready to be published on Topic
+ * Raw is set for the frames published undecoded, which have no sensor
+ */
+type decodedReading struct {
+	Topic     string
+	Payload   string
+	Raw       bool
+	Sensor    Sensor
+	InfosType byte
+	Fields    map[string]interface{}
+	MaxStale  time.Duration
+}
+
+/**
+ * Decode a message from RFPlayer and publish it
+ */
+func decode(l int, m []byte) {
+	configLock.RLock() // The caches of the sensors are not rebuilt while the frame is decoded
+	defer configLock.RUnlock()
+
+	r, ok := decodeFrame(l, m)
+	if !ok {
+		return
+	}
+
+	if r.Raw {
+		publishReading(r.Topic, r.Payload)
+		return
+	}
+
+	/**
+	 * Send the MQTT message in non blocking way
+	 */
+	log.Debug("Publication MQTT jsonString : ", r.Payload)
+	metricFramesDecoded.Inc()
+	for _, t := range readingTopics(r.Topic, r.Sensor.Ref) {
+		publishReading(t, r.Payload)
+	}
+	if sensorsSeenCache != nil {
+		sensorsSeenCache.Set(r.Topic, r.Sensor.Ref, cache.DefaultExpiration)
+	}
+	if conf.GetBool("homeassistant.discovery") {
+		announceSensor(r.Sensor, r.InfosType, r.Fields)
+	}
+	if r.MaxStale > 0 {
+		staleReadingsCache.Set(r.Sensor.Ref, staleReading{r.Topic, r.Sensor, r.InfosType, r.Fields, time.Now(), r.MaxStale}, cache.NoExpiration)
+	}
+}
+
+/**
+ * Function that confirm the state of an actuator which has just been commanded, on <topicroot>/action/<name>/confirmed
+ * Called by decodeFrame before the reading can be dropped by brockermqtt.changeonly : a command repeating
+ * the current state is confirmed too
+ */
+func confirmActuator(sensor Sensor, infosType byte, fields map[string]interface{}) {
+	name, found := pendingConfirmsCache.Get(sensor.Ref)
+	if !found {
+		return
+	}
+	pendingConfirmsCache.Delete(sensor.Ref)
+
+	payload, err := readingPayload(sensor, infosType, fields)
+	if err != nil {
+		log.Error("Unable to build payload of ", sensor.Ref, ": ", err)
+		return
+	}
+
+	log.Info("State of actuator ", name, " confirmed by ", sensor.Ref)
+	go publish(brokerTopicRoot()+"/action/"+name.(string)+"/confirmed", string(payload))
+}
+
+/**
+ * Function that decode a message from RFPlayer into the topic and JSON payload of its reading, without publishing it
+ * false if the frame is dropped (too short, poor quality, no change...), after confirming the state of an actuator waiting for it
+ */
+func decodeFrame(l int, m []byte) (decodedReading, bool) {
+	fields := map[string]interface{}{}
+
+	timecodeString := time.Now().Format(time.RFC3339)
+
+	sensor := Sensor{}
+
+	/**
+	 * A truncated or corrupted frame must not be read out of its bounds
+	 */
+	if l < regularIncomingRFBinaryUSBFrameHeaderLength || len(m) < l {
+		log.Warn("Frame too short (", l, " bytes), ignored : ", hex.EncodeToString(m))
+		metricFramesRejected.WithLabelValues("short").Inc()
+		return decodedReading{}, false
+	}
+
+	if m[5] == rflinkIncomingBinaryUSBFrameType {
+		metricFramesReceived.WithLabelValues("rflink").Inc()
+	} else {
+		metricFramesReceived.WithLabelValues(receivedProtocolName(m[11])).Inc()
+	}
+
+	/**
+	 * Only regular binary frames are decoded, RFLINK and unknown frames are published raw
+	 */
+	switch m[5] {
+	case regularIncomingBinaryUSBFrameType:
+	case rflinkIncomingBinaryUSBFrameType:
+		log.Debug("RFLINK frame : ", hex.EncodeToString(m[:l]))
+		return rawFrame(brokerTopicRoot()+"/rflink", fields, l, m)
+	default:
+		log.Warn("Unknown frameType ", m[5], ", frame : ", hex.EncodeToString(m[:l]))
+		return rawFrame(brokerTopicRoot()+"/unknown", fields, l, m)
+	}
+
+	log.Debug("RFLevel=", int8(m[8]), ", FloorNoise=", int8(m[9]), ", RFQuality=", m[10], ", Protocol=", m[11], ", InfosType=", m[12])
+
+	/**
+	 * Drop the frames of RF quality 0, a corruption signature on some setups
+	 */
+	if m[10] == 0 && conf.GetBool("rfplayer.dropzeroquality") {
+		n := atomic.AddUint64(&zeroQualityFrames, 1)
+		log.Debug("Frame dropped, RFQuality=0 (", n, " frames dropped)")
+		metricFramesRejected.WithLabelValues("zeroquality").Inc()
+		return decodedReading{}, false
+	}
+
+	/**
+	 * Drop the frames of poor quality, often corrupted
+	 */
+	if int(m[10]) < conf.GetInt("rfplayer.minquality") || int(int8(m[8])) < conf.GetInt("rfplayer.minrflevel") {
+		n := atomic.AddUint64(&lowQualityFrames, 1)
+		log.Debug("Frame dropped, RFQuality=", m[10], ", RFLevel=", int8(m[8]), " (", n, " frames dropped)")
+		metricFramesRejected.WithLabelValues("quality").Inc()
+		return decodedReading{}, false
+	}
+
+	if minLength, found := infosTypeMinLength[m[12]]; found && l < minLength {
+		log.Warn("Frame of infosType ", m[12], " too short (", l, " bytes instead of ", minLength, "), ignored : ", hex.EncodeToString(m[:l]))
+		metricFramesRejected.WithLabelValues("short").Inc()
+		return decodedReading{}, false
+	}
+
+	/**
+	 * RF metrics of the header, common to all infosTypes, to diagnose the range of the sensors
+	 */
+	if conf.GetBool("brockermqtt.includerfmetrics") {
+		fields["rflevel"] = strconv.Itoa(int(int8(m[8])))
+		fields["floornoise"] = strconv.Itoa(int(int8(m[9])))
+		fields["rfquality"] = strconv.Itoa(int(m[10]))
+	}
+
+	switch m[12] {
+	case infosType0:
+		log.Debug(", X10, DOMIA_LITE, PARROT")
+		log.Debug(", SubType=", binary.LittleEndian.Uint16(m[13:]))
+		log.Debug(", Id=", binary.LittleEndian.Uint32(m[15:]))
+
+		sensor.Ref = strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[13:])), 10)
+		sensor.Protocol = "X10"
+		switch m[11] {
+		case receivedProtocolEDISIO:
+			sensor.Protocol = "EDISIO"
+		case receivedProtocolPARROT:
+			sensor.Protocol = "PARROT"
+		}
+		sensor.SubType = strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[13:])), 10)
+		sensor.Name = sensorName(sensor.Ref)
+		sensor.Topic = sensorTopic(sensor.Ref)
+		if sensor.Topic == "NULL" {
+			sensor.Topic = fallbackTopic(sensor.Ref, strings.ToLower(sensor.Protocol), m[7])
+		}
+		log.Debug(", topic=", sensor.Topic)
+
+		/**
+		 * A code learned by the dongle (PARROT) is reported with the id of its slot, the subtype being the action
+		 */
+		if sensor.Protocol == "PARROT" {
+			fields["slot"] = strconv.FormatUint(uint64(binary.LittleEndian.Uint16(m[15:])), 10)
+			fields["band"] = rfBand(m[7])
+		}
+
+	case infosType1:
+		log.Debug(", CHACON ...")
+		log.Debug(", SubType=", binary.LittleEndian.Uint16(m[13:]))
+		log.Debug(", Id=", binary.LittleEndian.Uint32(m[15:]))
+
+		sensor.Ref = "1-" + strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[15:])), 10)
+		sensor.Protocol = "CHACON"
+		if m[11] == receivedProtocolEDISIO {
+			sensor.Protocol = "EDISIO"
+		}
+		sensor.SubType = strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[13:])), 10)
+		sensor.Name = sensorName(sensor.Ref)
+		sensor.Topic = sensorTopic(sensor.Ref)
+		if sensor.Topic == "NULL" {
+			sensor.Topic = fallbackTopic(sensor.Ref, strings.ToLower(sensor.Protocol), m[7])
+		}
+		log.Debug(", topic=", sensor.Topic)
+
+		if sensor.Protocol == "CHACON" {
+			deviceType := chaconDeviceType(binary.LittleEndian.Uint16(m[13:]))
+
+			fields["devicetype"] = deviceType
+		}
+
+	case infosType2:
+		log.Debug(", VISONIC")
+		log.Debug(", SubType=", binary.LittleEndian.Uint16(m[13:]))
+		log.Debug(", Id=", binary.LittleEndian.Uint32(m[15:]))
+		log.Debug(", qualifier=", binary.LittleEndian.Uint16(m[19:]))
+
+		sensor.Ref = "2-" + strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[15:])), 10)
+		sensor.Protocol = "VISONIC"
+		sensor.SubType = strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[13:])), 10)
+		sensor.Name = sensorName(sensor.Ref)
+		sensor.Topic = sensorTopic(sensor.Ref)
+		if sensor.Topic == "NULL" {
+			sensor.Topic = fallbackTopic(sensor.Ref, "visonic", m[7])
+		}
+		log.Debug(", topic=", sensor.Topic)
+
+		qualifierString := strconv.FormatUint(uint64(binary.LittleEndian.Uint16(m[19:])), 10)
+
+		fields["q"] = qualifierString
+		fields["ftamper"] = testBit(m[19], 0)  // tamper flag
+		fields["falarm"] = testBit(m[19], 1)   // alarm flag
+		fields["flowbatt"] = testBit(m[19], 2) // low batt flag
+		fields["falive"] = testBit(m[19], 3)   // supervisor message flag
+		if fields["falive"] == "1" {
+			if interval, ok := supervisionInterval(sensor.Ref, time.Now()); ok {
+				fields["supervision_interval_s"] = strconv.FormatFloat(interval, 'f', 0, 64)
+			}
+		}
+
+	case infosType3:
+		log.Debug(", RTS")
+		log.Debug(", SubType=", binary.LittleEndian.Uint16(m[13:]))
+		log.Debug(", Id=", binary.LittleEndian.Uint32(m[15:]))
+		log.Debug(", qualifier=", binary.LittleEndian.Uint16(m[19:]))
+
+		sensor.Ref = "3-" + strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[15:])), 10)
+		sensor.Protocol = "RTS"
+		sensor.SubType = strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[13:])), 10)
+		sensor.Name = sensorName(sensor.Ref)
+		sensor.Topic = sensorTopic(sensor.Ref)
+		if sensor.Topic == "NULL" {
+			sensor.Topic = fallbackTopic(sensor.Ref, "rts", m[7])
+		}
+		log.Debug(", topic=", sensor.Topic)
+
+		qualifierString := strconv.FormatUint(uint64(binary.LittleEndian.Uint16(m[19:])), 10)
+
+		fields["q"] = qualifierString
+
+	case infosType4:
+		log.Debug(", OREGON Thermo/Hygro")
+		log.Debug(", SubType=", binary.LittleEndian.Uint16(m[13:]))
+		log.Debug(", idPHY=", binary.LittleEndian.Uint16(m[15:]))
+		log.Debug(", idChannel=", binary.LittleEndian.Uint16(m[17:]))
+		log.Debug(", qualifier=", binary.LittleEndian.Uint16(m[19:]))
+		log.Debug(", temp=", int16(binary.LittleEndian.Uint16(m[21:])))
+		log.Debug(", hygro=", binary.LittleEndian.Uint16(m[23:]))
+
+		sensor.Ref = "4-" + strconv.FormatUint(uint64(touint32(binary.LittleEndian.Uint16(m[15:]), binary.LittleEndian.Uint16(m[17:]))), 10)
+		sensor.Protocol = "OREGON"
+		sensor.SubType = strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[13:])), 10)
+		sensor.Name = sensorName(sensor.Ref)
+		sensor.Topic = sensorTopic(sensor.Ref)
+		if sensor.Topic == "NULL" {
+			sensor.Topic = fallbackTopic(sensor.Ref, "th", m[7])
+		}
+		log.Debug(", topic=", sensor.Topic)
+
+		tempString := temperature(binary.LittleEndian.Uint16(m[21:]))
+
+		fields["t"] = tempString
+		if oregonTemp2(binary.LittleEndian.Uint16(m[13:])) {
+			fields["temp2_c"] = temperature(binary.LittleEndian.Uint16(m[23:])) // second probe in the hygro word
+		} else if !setHumidity(sensor, binary.LittleEndian.Uint16(m[23:]), fields) {
+			return decodedReading{}, false
+		}
+		fields["flowbatt"] = testBit(m[19], 0) // low batt flag
+		//		} else {
+		//			log.Info("RFLevel=", int8(m[8]), ", FloorNoise=", int8(m[9]), ", RFQuality=", m[10], ", Protocol=", m[11], ", InfosType=", m[12])
+		//			log.Info("Topic problem : topic=>", sensor.Topic, "<, len=", len(topicSplit), ", Sensor Ref:>", sensor.Ref, "<")
+		//		}
+
+	case infosType5:
+		log.Debug(", OREGON Atmo pressure")
+		log.Debug(", SubType=", binary.LittleEndian.Uint16(m[13:]))
+		log.Debug(", idPHY=", binary.LittleEndian.Uint16(m[15:]))
+		log.Debug(", idChannel=", binary.LittleEndian.Uint16(m[17:]))
+		log.Debug(", qualifier=", binary.LittleEndian.Uint16(m[19:]))
+		log.Debug(", temp=", int16(binary.LittleEndian.Uint16(m[21:])))
+		log.Debug(", hygro=", binary.LittleEndian.Uint16(m[23:]))
+		log.Debug(", pressure=", binary.LittleEndian.Uint16(m[25:]))
+
+		sensor.Ref = "5-" + strconv.FormatUint(uint64(touint32(binary.LittleEndian.Uint16(m[15:]), binary.LittleEndian.Uint16(m[17:]))), 10)
+		sensor.Protocol = "OREGON"
+		sensor.SubType = strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[13:])), 10)
+		sensor.Name = sensorName(sensor.Ref)
+		sensor.Topic = sensorTopic(sensor.Ref)
+		if sensor.Topic == "NULL" {
+			sensor.Topic = fallbackTopic(sensor.Ref, "thpa", m[7])
+		}
+		log.Debug(", topic=", sensor.Topic)
+
+		tempString := temperature(binary.LittleEndian.Uint16(m[21:]))
+		pressureString := strconv.FormatUint(uint64(binary.LittleEndian.Uint16(m[25:])), 10)
+
+		fields["t"] = tempString
+		if !setHumidity(sensor, binary.LittleEndian.Uint16(m[23:]), fields) {
+			return decodedReading{}, false
+		}
+		fields["p"] = pressureString
+		fields["flowbatt"] = testBit(m[19], 0) // low batt flag
+
+	case infosType6:
+		log.Debug(", OREGON Wind")
 		log.Debug(", SubType=", binary.LittleEndian.Uint16(m[13:]))
 		log.Debug(", idPHY=", binary.LittleEndian.Uint16(m[15:]))
 		log.Debug(", idChannel=", binary.LittleEndian.Uint16(m[17:]))
@@ -656,356 +1741,1049 @@ func decode(l int, m []byte) {
 		log.Debug(", speed=", binary.LittleEndian.Uint16(m[21:]))
 		log.Debug(", direction=", binary.LittleEndian.Uint16(m[23:]))
 
-		sensor.Ref = "6-" + strconv.FormatUint(uint64(touint32(binary.LittleEndian.Uint16(m[15:]), binary.LittleEndian.Uint16(m[17:]))), 10)
-		sensor.Protocol = "OREGON"
+		sensor.Ref = "6-" + strconv.FormatUint(uint64(touint32(binary.LittleEndian.Uint16(m[15:]), binary.LittleEndian.Uint16(m[17:]))), 10)
+		sensor.Protocol = "OREGON"
+		sensor.SubType = strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[13:])), 10)
+		sensor.Name = sensorName(sensor.Ref)
+		sensor.Topic = sensorTopic(sensor.Ref)
+		if sensor.Topic == "NULL" {
+			sensor.Topic = fallbackTopic(sensor.Ref, "wind", m[7])
+		}
+		log.Debug(", topic=", sensor.Topic)
+
+		speedString := strconv.FormatUint(uint64(binary.LittleEndian.Uint16(m[21:])), 10)
+		directionString := strconv.FormatUint(uint64(binary.LittleEndian.Uint16(m[23:])), 10)
+
+		fields["s"] = speedString
+		fields["d"] = directionString
+		fields["flowbatt"] = testBit(m[19], 0) // low batt flag
+
+	case infosType7:
+		log.Debug(", OREGON UV")
+		log.Debug(", SubType=", binary.LittleEndian.Uint16(m[13:]))
+		log.Debug(", idPHY=", binary.LittleEndian.Uint16(m[15:]))
+		log.Debug(", idChannel=", binary.LittleEndian.Uint16(m[17:]))
+		log.Debug(", qualifier=", binary.LittleEndian.Uint16(m[19:]))
+		log.Debug(", light=", binary.LittleEndian.Uint16(m[21:]))
+
+		sensor.Ref = "7-" + strconv.FormatUint(uint64(touint32(binary.LittleEndian.Uint16(m[15:]), binary.LittleEndian.Uint16(m[17:]))), 10)
+		sensor.Protocol = "OREGON"
+		sensor.SubType = strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[13:])), 10)
+		sensor.Name = sensorName(sensor.Ref)
+		sensor.Topic = sensorTopic(sensor.Ref)
+		if sensor.Topic == "NULL" {
+			sensor.Topic = fallbackTopic(sensor.Ref, "uv", m[7])
+		}
+		log.Debug(", topic=", sensor.Topic)
+
+		lightString := strconv.FormatUint(uint64(binary.LittleEndian.Uint16(m[21:])), 10)
+
+		fields["l"] = lightString
+		fields["flowbatt"] = testBit(m[19], 0) // low batt flag
+
+	case infosType8:
+		log.Debug(", OWL")
+		log.Debug(", SubType=", binary.LittleEndian.Uint16(m[13:]))
+		log.Debug(", idPHY=", binary.LittleEndian.Uint16(m[15:]))
+		log.Debug(", idChannel=", binary.LittleEndian.Uint16(m[17:]))
+		log.Debug(", qualifier=", binary.LittleEndian.Uint16(m[19:]))
+		log.Debug(", energy=", binary.LittleEndian.Uint32(m[21:]))
+		log.Debug(", power=", binary.LittleEndian.Uint16(m[25:]))
+		log.Debug(", powerI1=", binary.LittleEndian.Uint16(m[27:]))
+		log.Debug(", powerI2=", binary.LittleEndian.Uint16(m[29:]))
+		log.Debug(", powerI3=", binary.LittleEndian.Uint16(m[31:]))
+
+		sensor.Ref = "8-" + strconv.FormatUint(uint64(touint32(binary.LittleEndian.Uint16(m[15:]), binary.LittleEndian.Uint16(m[17:]))), 10)
+		sensor.Protocol = "OWL"
+		sensor.SubType = strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[13:])), 10)
+		sensor.Name = sensorName(sensor.Ref)
+		sensor.Topic = sensorTopic(sensor.Ref)
+		if sensor.Topic == "NULL" {
+			sensor.Topic = fallbackTopic(sensor.Ref, "owl", m[7])
+		}
+		log.Debug(", topic=", sensor.Topic)
+
+		energyString := strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[21:])), 10)
+		powerString := strconv.FormatUint(uint64(binary.LittleEndian.Uint16(m[25:])), 10)
+		powerI1String := strconv.FormatUint(uint64(binary.LittleEndian.Uint16(m[27:])), 10)
+		powerI2String := strconv.FormatUint(uint64(binary.LittleEndian.Uint16(m[29:])), 10)
+		powerI3String := strconv.FormatUint(uint64(binary.LittleEndian.Uint16(m[31:])), 10)
+		channelString := strconv.FormatUint(uint64(binary.LittleEndian.Uint16(m[17:])), 10)
+
+		fields["e"] = energyString
+		fields["p"] = powerString
+		fields["pi1"] = powerI1String
+		fields["pi2"] = powerI2String
+		fields["pi3"] = powerI3String
+		fields["channel"] = channelString
+		fields["flowbatt"] = testBit(m[19], 0) // low batt flag
+
+	case infosType9:
+		log.Debug(", OREGON Rain")
+		log.Debug(", SubType=", binary.LittleEndian.Uint16(m[13:]))
+		log.Debug(", idPHY=", binary.LittleEndian.Uint16(m[15:]))
+		log.Debug(", idChannel=", binary.LittleEndian.Uint16(m[17:]))
+		log.Debug(", qualifier=", binary.LittleEndian.Uint16(m[19:]))
+		log.Debug(", totalRain=", binary.LittleEndian.Uint32(m[21:]))
+		log.Debug(", rain=", binary.LittleEndian.Uint16(m[25:]))
+
+		sensor.Ref = "9-" + strconv.FormatUint(uint64(touint32(binary.LittleEndian.Uint16(m[15:]), binary.LittleEndian.Uint16(m[17:]))), 10)
+		sensor.Protocol = "OREGON"
+		sensor.SubType = strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[13:])), 10)
+		sensor.Name = sensorName(sensor.Ref)
+		sensor.Topic = sensorTopic(sensor.Ref)
+		if sensor.Topic == "NULL" {
+			sensor.Topic = fallbackTopic(sensor.Ref, "rain", m[7])
+		}
+		log.Debug(", topic=", sensor.Topic)
+
+		totalrainString := strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[21:])), 10)
+		rainString := strconv.FormatUint(uint64(binary.LittleEndian.Uint16(m[25:])), 10)
+
+		fields["tra"] = totalrainString
+		fields["ra"] = rainString
+		fields["flowbatt"] = testBit(m[19], 0) // low batt flag
+
+	case infosType10:
+		log.Debug(", X2D Thermostat")
+		log.Debug(", SubType=", binary.LittleEndian.Uint16(m[13:]))
+		log.Debug(", id=", binary.LittleEndian.Uint32(m[15:]))
+		log.Debug(", qualifier=", binary.LittleEndian.Uint16(m[19:]))
+		log.Debug(", fonction=", binary.LittleEndian.Uint16(m[21:]))
+		log.Debug(", mode=", binary.LittleEndian.Uint16(m[23:]))
+		log.Debug(", data[4]=", binary.LittleEndian.Uint16(m[25:]))
+
+		sensor.Ref = "10-" + strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[15:])), 10)
+		sensor.Protocol = "X2D"
+		sensor.SubType = strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[13:])), 10)
+		sensor.Name = sensorName(sensor.Ref)
+		sensor.Topic = sensorTopic(sensor.Ref)
+		if sensor.Topic == "NULL" {
+			sensor.Topic = fallbackTopic(sensor.Ref, "x2dcontact", m[7])
+		}
+		log.Debug(", topic=", sensor.Topic)
+
+		qualifierString := strconv.FormatUint(uint64(binary.LittleEndian.Uint16(m[19:])), 10)
+
+		fields["q"] = qualifierString
+		fields["ftamper"] = testBit(m[19], 0)    // tamper flag
+		fields["fanomaly"] = testBit(m[19], 1)   // anomaly flag
+		fields["flowbatt"] = testBit(m[19], 2)   // low batt flag
+		fields["ftestassoc"] = testBit(m[19], 4) // test assoc flag
+		fields["fdomestic"] = testBit(m[19], 5)  // domestic frame flag
+		if state, found := x2dRelayState(binary.LittleEndian.Uint16(m[21:]), binary.LittleEndian.Uint16(m[23:])); found {
+			fields["relay_state"] = state
+		}
+
+	case infosType11:
+		log.Debug(", X2D Shutter")
+		log.Debug(", SubType=", binary.LittleEndian.Uint16(m[13:]))
+		log.Debug(", id=", binary.LittleEndian.Uint32(m[15:]))
+		log.Debug(", qualifier=", binary.LittleEndian.Uint16(m[19:]))
+		log.Debug(", fonction=", binary.LittleEndian.Uint16(m[21:]))
+		log.Debug(", reserved2=", binary.LittleEndian.Uint16(m[23:]))
+		log.Debug(", data[4]=", binary.LittleEndian.Uint16(m[25:]))
+
+		sensor.Ref = "11-" + strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[15:])), 10)
+		sensor.Protocol = "X2D"
+		sensor.SubType = strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[13:])), 10)
+		sensor.Name = sensorName(sensor.Ref)
+		sensor.Topic = sensorTopic(sensor.Ref)
+		if sensor.Topic == "NULL" {
+			sensor.Topic = fallbackTopic(sensor.Ref, "x2dshutter", m[7])
+		}
+		log.Debug(", topic=", sensor.Topic)
+
+		qualifierString := strconv.FormatUint(uint64(binary.LittleEndian.Uint16(m[19:])), 10)
+
+		fields["q"] = qualifierString
+		fields["ftamper"] = testBit(m[19], 0)    // tamper flag
+		fields["fanomaly"] = testBit(m[19], 1)   // anomaly flag
+		fields["flowbatt"] = testBit(m[19], 2)   // low batt flag
+		fields["ftestassoc"] = testBit(m[19], 4) // test assoc flag
+		fields["fdomestic"] = testBit(m[19], 5)  // domestic frame flag
+		if action, found := x2dShutterAction(binary.LittleEndian.Uint16(m[21:])); found {
+			fields["shutter_action"] = action
+		}
+
+	case infosType12:
+		log.Debug(", deprecated")
+		log.Debug(", SubType=", binary.LittleEndian.Uint16(m[13:]))
+		log.Debug(", id=", binary.LittleEndian.Uint32(m[15:]))
+		log.Debug(", qualifier=", binary.LittleEndian.Uint16(m[19:]))
+		log.Debug(", temp=", (int16)(binary.LittleEndian.Uint16(m[21:])))
+		log.Debug(", setPoint=", (int16)(binary.LittleEndian.Uint16(m[23:])))
+
+		sensor.Ref = "12-" + strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[15:])), 10)
+		sensor.Protocol = "DEPRECATED"
 		sensor.SubType = strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[13:])), 10)
 		sensor.Name = sensorName(sensor.Ref)
 		sensor.Topic = sensorTopic(sensor.Ref)
 		if sensor.Topic == "NULL" {
-			sensor.Topic = conf.GetString("brokermqtt.topicroot") + "/" + sensor.Ref + "/wind"
+			sensor.Topic = fallbackTopic(sensor.Ref, "null", m[7])
 		}
 		log.Debug(", topic=", sensor.Topic)
 
-		speedString := strconv.FormatUint(uint64(binary.LittleEndian.Uint16(m[21:])), 10)
-		directionString := strconv.FormatUint(uint64(binary.LittleEndian.Uint16(m[23:])), 10)
-
-		topicSplit := strings.Split(sensor.Topic, "/")
+		qualifierString := strconv.FormatUint(uint64(binary.LittleEndian.Uint16(m[19:])), 10)
+		tempString := temperature(binary.LittleEndian.Uint16(m[21:]))
 
-		jsonString = "{ \"tc\": \"" + timecodeString
-		jsonString = jsonString + "\" , \"n\": \"" + topicSplit[1]
-		jsonString = jsonString + "\" , \"r\": \"" + sensor.Ref
-		jsonString = jsonString + "\" , \"s\": \"" + speedString
-		jsonString = jsonString + "\" , \"d\": \"" + directionString
-		jsonString = jsonString + "\" , \"flowbatt\": \"" + testBit(m[19], 0) // low batt flag
-		jsonString = jsonString + "\" , \"st\": \"" + sensor.SubType
-		jsonString = jsonString + "\" }"
+		fields["q"] = qualifierString
+		fields["t"] = tempString
 
-	case infosType7:
-		log.Debug(", OREGON UV")
+	case infosType13:
+		log.Debug(", Linky")
 		log.Debug(", SubType=", binary.LittleEndian.Uint16(m[13:]))
-		log.Debug(", idPHY=", binary.LittleEndian.Uint16(m[15:]))
-		log.Debug(", idChannel=", binary.LittleEndian.Uint16(m[17:]))
+		log.Debug(", id=", ticID(m))
 		log.Debug(", qualifier=", binary.LittleEndian.Uint16(m[19:]))
-		log.Debug(", light=", binary.LittleEndian.Uint16(m[21:]))
+		log.Debug(", contractType=", binary.LittleEndian.Uint16(m[21:]))
+		log.Debug(", cnt1=", binary.LittleEndian.Uint32(m[23:]))
+		log.Debug(", cnt2=", binary.LittleEndian.Uint32(m[27:]))
+		log.Debug(", apparentPower=", binary.LittleEndian.Uint16(m[31:]))
 
-		sensor.Ref = "7-" + strconv.FormatUint(uint64(touint32(binary.LittleEndian.Uint16(m[15:]), binary.LittleEndian.Uint16(m[17:]))), 10)
-		sensor.Protocol = "OREGON"
+		sensor.Ref = "13-" + strconv.FormatUint(ticID(m), 10)
+		sensor.Protocol = "LINKY"
 		sensor.SubType = strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[13:])), 10)
 		sensor.Name = sensorName(sensor.Ref)
 		sensor.Topic = sensorTopic(sensor.Ref)
 		if sensor.Topic == "NULL" {
-			sensor.Topic = conf.GetString("brokermqtt.topicroot") + "/" + sensor.Ref + "/uv"
+			sensor.Topic = fallbackTopic(sensor.Ref, "linky", m[7])
 		}
 		log.Debug(", topic=", sensor.Topic)
 
-		lightString := strconv.FormatUint(uint64(binary.LittleEndian.Uint16(m[21:])), 10)
-
-		topicSplit := strings.Split(sensor.Topic, "/")
-
-		jsonString = "{ \"tc\": \"" + timecodeString
-		jsonString = jsonString + "\" , \"n\": \"" + topicSplit[1]
-		jsonString = jsonString + "\" , \"r\": \"" + sensor.Ref
-		jsonString = jsonString + "\" , \"l\": \"" + lightString
-		jsonString = jsonString + "\" , \"flowbatt\": \"" + testBit(m[19], 0) // low batt flag
-		jsonString = jsonString + "\" , \"st\": \"" + sensor.SubType
-		jsonString = jsonString + "\" }"
+		contracttypeString := strconv.FormatUint(uint64(binary.LittleEndian.Uint16(m[21:])), 10)
+		cnt1String := strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[23:])), 10) // index 1 (base or HC)
+		cnt2String := strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[27:])), 10) // index 2 (HP)
+		apparentpowerString := ticValue(binary.LittleEndian.Uint16(m[31:]), ticSigned(binary.LittleEndian.Uint16(m[13:])))
+		qualifierString := strconv.FormatUint(uint64(m[19]), 10) // D0-7 : flags, D8-15 : idMsb2
+
+		cnt1Total, cnt1Rollover := ticCounterTotal(sensor.Ref, "cnt1", binary.LittleEndian.Uint32(m[23:]))
+		cnt2Total, cnt2Rollover := ticCounterTotal(sensor.Ref, "cnt2", binary.LittleEndian.Uint32(m[27:]))
+
+		fields["ct"] = contracttypeString
+		fields["cnt1"] = cnt1String
+		fields["cnt2"] = cnt2String
+		fields["cnt1_total"] = strconv.FormatUint(cnt1Total, 10)
+		fields["cnt2_total"] = strconv.FormatUint(cnt2Total, 10)
+		fields["rollover"] = "0"
+		if cnt1Rollover || cnt2Rollover {
+			fields["rollover"] = "1"
+		}
+		fields["ap"] = apparentpowerString
+		fields["q"] = qualifierString
 
-	case infosType8:
-		log.Debug(", OWL")
+	case infosType14:
+		log.Debug(", FS20")
 		log.Debug(", SubType=", binary.LittleEndian.Uint16(m[13:]))
-		log.Debug(", idPHY=", binary.LittleEndian.Uint16(m[15:]))
-		log.Debug(", idChannel=", binary.LittleEndian.Uint16(m[17:]))
+		log.Debug(", id=", binary.LittleEndian.Uint32(m[15:]))
 		log.Debug(", qualifier=", binary.LittleEndian.Uint16(m[19:]))
-		log.Debug(", energy=", binary.LittleEndian.Uint32(m[21:]))
-		log.Debug(", power=", binary.LittleEndian.Uint32(m[25:]))
-		log.Debug(", powerI1=", binary.LittleEndian.Uint32(m[27:]))
-		log.Debug(", powerI2=", binary.LittleEndian.Uint32(m[29:]))
-		log.Debug(", powerI3=", binary.LittleEndian.Uint32(m[31:]))
 
-		sensor.Ref = "8-" + strconv.FormatUint(uint64(touint32(binary.LittleEndian.Uint16(m[15:]), binary.LittleEndian.Uint16(m[17:]))), 10)
-		sensor.Protocol = "OWL"
+		sensor.Ref = "14-" + strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[15:])), 10)
+		sensor.Protocol = "FS20"
 		sensor.SubType = strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[13:])), 10)
 		sensor.Name = sensorName(sensor.Ref)
 		sensor.Topic = sensorTopic(sensor.Ref)
 		if sensor.Topic == "NULL" {
-			sensor.Topic = conf.GetString("brokermqtt.topicroot") + "/" + sensor.Ref + "/owl"
+			sensor.Topic = fallbackTopic(sensor.Ref, "fs20", m[7])
 		}
 		log.Debug(", topic=", sensor.Topic)
 
-		energyString := strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[21:])), 10)
-		powerString := strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[25:])), 10)
-		powerI1String := strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[27:])), 10)
-		powerI2String := strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[29:])), 10)
-		powerI3String := strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[31:])), 10)
-
-		topicSplit := strings.Split(sensor.Topic, "/")
-
-		jsonString = "{ \"tc\": \"" + timecodeString
-		jsonString = jsonString + "\" , \"n\": \"" + topicSplit[1]
-		jsonString = jsonString + "\" , \"r\": \"" + sensor.Ref
-		jsonString = jsonString + "\" , \"e\": \"" + energyString
-		jsonString = jsonString + "\" , \"p\": \"" + powerString
-		jsonString = jsonString + "\" , \"pi1\": \"" + powerI1String
-		jsonString = jsonString + "\" , \"pi2\": \"" + powerI2String
-		jsonString = jsonString + "\" , \"pi3\": \"" + powerI3String
-		jsonString = jsonString + "\" , \"flowbatt\": \"" + testBit(m[19], 0) // low batt flag
-		jsonString = jsonString + "\" , \"st\": \"" + sensor.SubType
-		jsonString = jsonString + "\" }"
+		qualifierString := strconv.FormatUint(uint64(binary.LittleEndian.Uint16(m[19:])), 10)
 
-	case infosType9:
-		log.Debug(", OREGON Rain")
+		fields["q"] = qualifierString
+
+	case infosType15:
+		log.Debug(", JAMMING")
 		log.Debug(", SubType=", binary.LittleEndian.Uint16(m[13:]))
-		log.Debug(", idPHY=", binary.LittleEndian.Uint16(m[15:]))
-		log.Debug(", idChannel=", binary.LittleEndian.Uint16(m[17:]))
-		log.Debug(", qualifier=", binary.LittleEndian.Uint16(m[19:]))
-		log.Debug(", totalRain=", binary.LittleEndian.Uint32(m[21:]))
-		log.Debug(", rain=", binary.LittleEndian.Uint16(m[25:]))
+		log.Debug(", Id=", binary.LittleEndian.Uint32(m[15:]))
 
-		sensor.Ref = "9-" + strconv.FormatUint(uint64(touint32(binary.LittleEndian.Uint16(m[15:]), binary.LittleEndian.Uint16(m[17:]))), 10)
-		sensor.Protocol = "OREGON"
+		sensor.Ref = "15-" + strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[15:])), 10)
+		sensor.Protocol = "JAMMING"
 		sensor.SubType = strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[13:])), 10)
 		sensor.Name = sensorName(sensor.Ref)
 		sensor.Topic = sensorTopic(sensor.Ref)
 		if sensor.Topic == "NULL" {
-			sensor.Topic = conf.GetString("brokermqtt.topicroot") + "/" + sensor.Ref + "/rain"
+			sensor.Topic = fallbackTopic(sensor.Ref, "jamming", m[7])
 		}
 		log.Debug(", topic=", sensor.Topic)
 
-		totalrainString := strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[21:])), 10)
-		rainString := strconv.FormatUint(uint64(binary.LittleEndian.Uint16(m[25:])), 10)
+		subtypeString := strconv.FormatUint(uint64(binary.LittleEndian.Uint16(m[13:])), 10)
+		severityString := jammingSeverity(int8(m[8]))
 
-		topicSplit := strings.Split(sensor.Topic, "/")
+		fields["s"] = subtypeString
+		fields["severity"] = severityString
 
-		jsonString = "{ \"tc\": \"" + timecodeString
-		jsonString = jsonString + "\" , \"n\": \"" + topicSplit[1]
-		jsonString = jsonString + "\" , \"r\": \"" + sensor.Ref
-		jsonString = jsonString + "\" , \"tra\": \"" + totalrainString
-		jsonString = jsonString + "\" , \"ra\": \"" + rainString
-		jsonString = jsonString + "\" , \"flowbatt\": \"" + testBit(m[19], 0) // low batt flag
-		jsonString = jsonString + "\" , \"st\": \"" + sensor.SubType
-		jsonString = jsonString + "\" }"
+	default:
+		/**
+		 * Unknown infosType (new firmware or corrupted frame), publish the raw frame for analysis
+		 */
+		log.Warn("Unknown infosType ", m[12], ", frame : ", hex.EncodeToString(m[:l]))
 
-	case infosType10:
-		log.Debug(", X2D Thermostat")
-		log.Debug(", SubType=", binary.LittleEndian.Uint16(m[13:]))
-		log.Debug(", id=", binary.LittleEndian.Uint32(m[15:]))
-		log.Debug(", qualifier=", binary.LittleEndian.Uint16(m[19:]))
-		log.Debug(", fonction=", binary.LittleEndian.Uint16(m[21:]))
-		log.Debug(", mode=", binary.LittleEndian.Uint16(m[23:]))
-		log.Debug(", data[4]=", binary.LittleEndian.Uint16(m[25:]))
+		fields["infostype"] = strconv.Itoa(int(m[12]))
+		return rawFrame(brokerTopicRoot()+"/unknown", fields, l, m)
+	}
 
-		sensor.Ref = "10-" + strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[15:])), 10)
-		sensor.Protocol = "X2D"
-		sensor.SubType = strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[13:])), 10)
-		sensor.Name = sensorName(sensor.Ref)
-		sensor.Topic = sensorTopic(sensor.Ref)
-		if sensor.Topic == "NULL" {
-			sensor.Topic = conf.GetString("brokermqtt.topicroot") + "/" + sensor.Ref + "/x2dcontact"
+	/**
+	 * Fields common to all frames
+	 */
+	fields["v"] = payloadVersion
+	fields[timeField()] = timecodeString
+	fields["n"] = topicName(sensor.Topic)
+	fields["r"] = sensor.Ref
+	if t := sensorType(sensor.Ref); t != "NULL" {
+		fields["type"] = t // Routing by the consumers without looking at the protocol
+	}
+	if sensor.Name != "NULL" {
+		metricRFLevel.WithLabelValues(sensor.Ref).Set(float64(int8(m[8]))) // Configured sensors only, not every ref heard around
+	}
+	fields["st"] = sensor.SubType
+	fields["srcdest"] = strconv.Itoa(int(m[2]))
+
+	if conf.GetBool("brockermqtt.asciitopics") {
+		sensor.Topic = asciiTopic(sensor.Topic) // n keeps the accents of the name
+	}
+
+	/**
+	 * A frame of another protocol than the expected one comes from another device sharing the ref
+	 */
+	if expected := sensorExpectedProtocol(sensor.Ref); expected != "NULL" && !strings.EqualFold(expected, sensor.Protocol) {
+		log.Warn("Sensor ", sensor.Ref, " expects protocol ", expected, " but received ", sensor.Protocol, ", ref collision ?")
+		if conf.GetBool("rfplayer.dropprotocolmismatch") {
+			return decodedReading{}, false
+		}
+	}
+
+	if protocol := sensorProtocol(sensor.Ref); protocol != "NULL" {
+		sensor.Protocol = protocol
+	}
+	fields["protocol"] = sensor.Protocol
+
+	if _, found := fields["q"]; found && conf.GetBool("brockermqtt.allqualifierbits") {
+		fields["bits"] = qualifierBits(m[19:21])
+	}
+
+	if conf.GetBool("brockermqtt.includeidhex") {
+		fields["id_hex"] = hex.EncodeToString(m[15:19]) // Device ID bytes, LSB first
+	}
+
+	transformFields(sensor, fields)
+	filterFields(sensor, fields)
+
+	if conf.GetBool("test.enabled") {
+		validateReading(sensor.Ref, fields)
+	}
+
+	confirmActuator(sensor, m[12], fields)
+
+	maxStale := sensorMaxStale(sensor.Ref)
+	if conf.GetBool("brockermqtt.changeonly") && !readingChanged(sensor.Ref, fields) && !readingStale(sensor.Ref, maxStale) {
+		log.Debug("No change for ", sensor.Ref, ", reading not published")
+		return decodedReading{}, false
+	}
+
+	if conf.GetBool("brockermqtt.includehash") {
+		fields["hash"] = readingHash(fields)
+	}
+
+	payload, err := readingPayload(sensor, m[12], fields)
+	if err != nil {
+		log.Error("Unable to build payload of ", sensor.Ref, ": ", err)
+		return decodedReading{}, false
+	}
+	jsonString := string(payload)
+
+	if maxSize := conf.GetInt("brockermqtt.maxpayloadsize"); maxSize > 0 && len(payload) > maxSize {
+		log.Error("Payload of ", sensor.Ref, " is ", len(payload), " bytes long, more than ", maxSize, ", reading dropped")
+		return decodedReading{}, false
+	}
+
+	return decodedReading{Topic: sensor.Topic, Payload: jsonString, Sensor: sensor, InfosType: m[12], Fields: fields, MaxStale: maxStale}, true
+}
+
+/**
+ * Function that return the reading of a frame which is not decoded, with its frame type and raw bytes in hexadecimal
+ */
+func rawFrame(t string, fields map[string]interface{}, l int, m []byte) (decodedReading, bool) {
+	fields["v"] = payloadVersion
+	fields[timeField()] = time.Now().Format(time.RFC3339)
+	fields["frametype"] = strconv.Itoa(int(m[5]))
+	fields["raw"] = hex.EncodeToString(m[:l])
+
+	payload, err := json.Marshal(fields)
+	if err != nil {
+		log.Error("Unable to build payload of raw frame: ", err)
+		return decodedReading{}, false
+	}
+
+	return decodedReading{Topic: t, Payload: string(payload), Raw: true, Fields: fields}, true
+}
+
+/**
+ * Decode an ASCII frame from RFPlayer (answer to a ZIA++ command)
+ */
+func decodeASCII(m []byte) {
+	log.Debug("ASCII frame raw bytes : ", hex.EncodeToString(m))
+
+	response := sanitizeASCII(m)
+	log.Debug("ASCII frame : ", response)
+
+	if atomic.LoadInt32(&initRunning) == 1 {
+		select {
+		case initAcks <- response:
+		default:
+		}
+	}
+
+	updateFlags(response)
+
+	go publish(brokerTopicRoot()+"/rfplayer/response", response)
+}
+
+/**
+ * Operational flags of the dongle, published retained on <topicroot>/rfplayer/flags
+ */
+type rfplayerFlags struct {
+	Tc           string `json:"tc"`
+	Repeater     string `json:"repeater,omitempty"`
+	RepeaterOn   bool   `json:"repeater_on"`
+	Jamming      string `json:"jamming,omitempty"`
+	JammingArmed bool   `json:"jamming_armed"`
+}
+
+var flagsRegexp = regexp.MustCompile(`(?i)\b(repeater|jamming)\s*[:=]\s*([a-z0-9]+)`)
+
+/**
+ * Function that read the repeater and jamming settings in a STATUS response and publish them if found
+ * A value 0 or OFF means disabled
+ */
+func updateFlags(response string) {
+	matches := flagsRegexp.FindAllStringSubmatch(response, -1)
+	if len(matches) == 0 {
+		return
+	}
+
+	flagsLock.Lock()
+	for _, match := range matches {
+		value := strings.ToUpper(match[2])
+		enabled := value != "0" && value != "OFF"
+		switch strings.ToLower(match[1]) {
+		case "repeater":
+			rfpFlags.Repeater = value
+			rfpFlags.RepeaterOn = enabled
+		case "jamming":
+			rfpFlags.Jamming = value
+			rfpFlags.JammingArmed = enabled
+		}
+	}
+	rfpFlags.Tc = time.Now().Format(time.RFC3339)
+	payload, err := json.Marshal(rfpFlags)
+	flagsLock.Unlock()
+
+	if err != nil {
+		log.Error("Unable to build flags message: ", err)
+		return
+	}
+
+	go publishMessage(brokerTopicRoot()+"/rfplayer/flags", 2, true, string(payload))
+}
+
+/**
+ * Function that keep only the printable characters of an ASCII frame
+ * Line noise could otherwise produce invalid UTF-8 strings
+ */
+func sanitizeASCII(m []byte) string {
+	var s strings.Builder
+
+	for _, c := range m {
+		if c >= ' ' && c <= '~' {
+			s.WriteByte(c)
+		}
+	}
+
+	return s.String()
+}
+
+/**
+ * Function called when a sensor has not been seen for brockermqtt.sensorexpire seconds
+ * With brockermqtt.clearonexpire, its retained reading is cleared so that no stale value lingers
+ */
+func sensorExpired(t string, ref interface{}) {
+	log.Info("Sensor ", ref, " not seen for ", conf.GetInt("brockermqtt.sensorexpire"), " seconds")
+
+	if !conf.GetBool("brockermqtt.clearonexpire") {
+		return
+	}
+
+	for _, topic := range readingTopics(t, ref.(string)) {
+		lastPublishedCache.Delete(topic)
+		go publishMessage(topic, 2, true, "")
+	}
+}
+
+/**
+ * Function that serialize the fields of a reading in the format set by brockermqtt.payloadformat
+ * - native : the fields as decoded
+ * - tasmota : the shape of the tele/.../SENSOR messages of Tasmota
+ */
+func readingPayload(sensor Sensor, infosType byte, fields map[string]interface{}) ([]byte, error) {
+	if conf.GetString("brockermqtt.payloadformat") == "tasmota" {
+		return json.Marshal(tasmotaFields(sensor, infosType, fields))
+	}
+
+	return json.Marshal(fields)
+}
+
+/**
+ * Tasmota names of the fields, the other fields are not published in tasmota format
+ */
+var tasmotaKeys = map[string]string{
+	"t":        "Temperature",
+	"h":        "Humidity",
+	"temp2_c":  "Temperature2",
+	"p":        "Pressure",
+	"l":        "UvIndex",
+	"d":        "WindDirection",
+	"flowbatt": "BatteryLow",
+	"falarm":   "Alarm",
+	"ftamper":  "Tamper",
+}
+
+/**
+ * Function that map the fields of a reading to a Tasmota SENSOR message
+ * The values are in an object named after the sensor, OWL readings in an ENERGY object
+ */
+func tasmotaFields(sensor Sensor, infosType byte, fields map[string]interface{}) map[string]interface{} {
+	number := func(v interface{}) interface{} {
+		if str, ok := v.(string); ok {
+			if f, err := strconv.ParseFloat(str, 64); err == nil {
+				return f
+			}
+		}
+		return v
+	}
+
+	device := map[string]interface{}{"Id": sensor.Ref}
+	message := map[string]interface{}{"Time": time.Now().Format("2006-01-02T15:04:05")}
+
+	if infosType == infosType8 {
+		// OWL energy meters, total in kWh as Tasmota
+		if p, found := fields["p"]; found {
+			device["Power"] = number(p)
+		}
+		if e, found := fields["e"]; found {
+			if total, ok := number(e).(float64); ok {
+				device["Total"] = total / 1000
+			}
+		}
+		message["ENERGY"] = device
+		return message
+	}
+
+	for k, v := range fields {
+		if key, found := tasmotaKeys[k]; found {
+			device[key] = number(v)
+		}
+	}
+
+	name := sensor.Name
+	if name == "NULL" {
+		name = sensor.Ref
+	}
+	message[name] = device
+
+	if _, found := fields["t"]; found {
+		message["TempUnit"] = "C"
+	}
+	if _, found := fields["p"]; found {
+		message["PressureUnit"] = "hPa"
+	}
+
+	return message
+}
+
+/**
+ * Last reading published of a sensor with a maximum staleness
+ */
+type staleReading struct {
+	Topic     string
+	Sensor    Sensor
+	InfosType byte
+	Fields    map[string]interface{}
+	Published time.Time
+	MaxStale  time.Duration
+}
+
+/**
+ * Function that tell if the last reading of a sensor was published more than maxStale ago
+ */
+func readingStale(ref string, maxStale time.Duration) bool {
+	if maxStale <= 0 {
+		return false
+	}
+
+	foo, found := staleReadingsCache.Get(ref)
+	if !found {
+		return true
+	}
+
+	return time.Since(foo.(staleReading).Published) >= maxStale
+}
+
+/**
+ * Function that publish again, with the current time, the last reading of the sensors
+ * which have published nothing during their maximum staleness
+ */
+func staleRepublisher() {
+	for {
+		time.Sleep(time.Second)
+
+		for ref, item := range staleReadingsCache.Items() {
+			r := item.Object.(staleReading)
+			if time.Since(r.Published) < r.MaxStale {
+				continue
+			}
+			if sensorsSeenCache != nil {
+				if _, seen := sensorsSeenCache.Get(r.Topic); !seen {
+					continue // Expired sensor, its reading is not kept alive
+				}
+			}
+
+			fields := map[string]interface{}{}
+			for k, v := range r.Fields {
+				fields[k] = v
+			}
+			fields[timeField()] = time.Now().Format(time.RFC3339)
+
+			payload, err := readingPayload(r.Sensor, r.InfosType, fields)
+			if err != nil {
+				log.Error("Unable to build payload of ", ref, ": ", err)
+				continue
+			}
+
+			log.Debug("No reading of ", ref, " for ", r.MaxStale, ", last reading published again")
+			for _, t := range readingTopics(r.Topic, r.Sensor.Ref) {
+				publishReading(t, string(payload))
+			}
+			r.Published = time.Now()
+			staleReadingsCache.Set(ref, r, cache.NoExpiration)
+		}
+	}
+}
+
+/**
+ * Home Assistant entity of a reading field
+ */
+type discoveryEntity struct {
+	Component   string // sensor or binary_sensor
+	DeviceClass string
+	Unit        string
+	Scale       string // Divider of the raw value, in the value template
+}
+
+/**
+ * Entities of the fields known by Home Assistant, the others are not announced
+ * The power p of OWL sensors and the alarm falarm are set in discoveryEntityOf
+ */
+var discoveryEntities = map[string]discoveryEntity{
+	"t":          {"sensor", "temperature", "°C", ""},
+	"h":          {"sensor", "humidity", "%", ""},
+	"temp2_c":    {"sensor", "temperature", "°C", ""},
+	"p":          {"sensor", "atmospheric_pressure", "hPa", ""},
+	"e":          {"sensor", "energy", "Wh", ""},
+	"pi1":        {"sensor", "power", "W", ""},
+	"pi2":        {"sensor", "power", "W", ""},
+	"pi3":        {"sensor", "power", "W", ""},
+	"s":          {"sensor", "wind_speed", "m/s", "10"},
+	"d":          {"sensor", "", "°", ""},
+	"l":          {"sensor", "", "UV index", ""},
+	"tra":        {"sensor", "precipitation", "mm", "10"},
+	"ra":         {"sensor", "precipitation_intensity", "mm/h", "100"},
+	"cnt1":       {"sensor", "energy", "Wh", ""},
+	"cnt1_total": {"sensor", "energy", "Wh", ""},
+	"cnt2_total": {"sensor", "energy", "Wh", ""},
+	"cnt2":       {"sensor", "energy", "Wh", ""},
+	"ap":         {"sensor", "apparent_power", "VA", ""},
+	"severity":   {"sensor", "", "", ""},
+	"flowbatt":   {"binary_sensor", "battery", "", ""},
+	"ftamper":    {"binary_sensor", "tamper", "", ""},
+	"falarm":     {"binary_sensor", "", "", ""},
+}
+
+/**
+ * Function that return the Home Assistant entity of a field for a frame of infosType
+ */
+func discoveryEntityOf(field string, infosType byte, ref string) (discoveryEntity, bool) {
+	entity, found := discoveryEntities[field]
+	if !found {
+		return entity, false
+	}
+
+	switch field {
+	case "p":
+		if infosType == infosType8 {
+			entity = discoveryEntity{"sensor", "power", "W", ""} // OWL
+		}
+	case "s":
+		if infosType == infosType15 {
+			entity = discoveryEntity{"sensor", "", "", ""} // Jamming subtype
+		}
+	case "falarm":
+		// Contacts are binary sensors of the class set by the deviceclass of the sensor, opening by default
+		if c := sensorDeviceClass(ref); c != "NULL" {
+			entity.DeviceClass = c
+		} else if infosType == infosType2 || infosType == infosType10 {
+			entity.DeviceClass = "opening"
+		}
+	}
+
+	return entity, true
+}
+
+/**
+ * Function that announce to Home Assistant the fields of a sensor not announced yet
+ * Each field is an entity, its config is published retained on <prefix>/<component>/<ref>/<field>/config
+ */
+func announceSensor(sensor Sensor, infosType byte, fields map[string]interface{}) {
+	for field := range fields {
+		entity, found := discoveryEntityOf(field, infosType, sensor.Ref)
+		if !found {
+			continue
+		}
+
+		topic := conf.GetString("homeassistant.prefix") + "/" + entity.Component + "/" + sensor.Ref + "/" + field + "/config"
+		if _, announced := discoveryCache.Get(topic); announced {
+			continue
+		}
+
+		name := sensor.Name
+		if name == "NULL" {
+			name = sensor.Ref
+		}
+
+		valueTemplate := "{{ value_json." + field + " }}"
+		if entity.Scale != "" {
+			valueTemplate = "{{ value_json." + field + " | float / " + entity.Scale + " }}"
+		}
+
+		entityConfig := map[string]interface{}{
+			"name":                  field,
+			"unique_id":             "rfp2mqtt_" + sensor.Ref + "_" + field,
+			"state_topic":           gatewayTopic(sensor.Topic),
+			"value_template":        valueTemplate,
+			"availability_topic":    gatewayTopic(statusTopic()),
+			"payload_available":     conf.GetString("brockermqtt.statusonline"),
+			"payload_not_available": conf.GetString("brockermqtt.statusoffline"),
+			"device": map[string]interface{}{
+				"identifiers": []string{"rfp2mqtt_" + sensor.Ref},
+				"name":        name,
+				"model":       sensor.Protocol,
+			},
+		}
+		if entity.DeviceClass != "" {
+			entityConfig["device_class"] = entity.DeviceClass
+		}
+		if entity.Unit != "" {
+			entityConfig["unit_of_measurement"] = entity.Unit
+		}
+		if entity.Component == "binary_sensor" {
+			entityConfig["payload_on"] = "1"
+			entityConfig["payload_off"] = "0"
+		} else if entity.DeviceClass == "energy" {
+			entityConfig["state_class"] = "total_increasing"
+		} else if entity.Unit != "" {
+			entityConfig["state_class"] = "measurement"
+		}
+
+		payload, err := json.Marshal(entityConfig)
+		if err != nil {
+			log.Error("Unable to build discovery config of ", sensor.Ref, ": ", err)
+			continue
 		}
-		log.Debug(", topic=", sensor.Topic)
 
-		qualifierString := strconv.FormatUint(uint64(binary.LittleEndian.Uint16(m[19:])), 10)
+		log.Info("[DISCOVERY] Announce ", field, " of ", sensor.Ref, " on ", topic)
+		discoveryCache.Set(topic, string(payload), cache.NoExpiration)
+		go mqttPublish(topic, 1, true, string(payload)) // Home Assistant only listens on its prefix
+	}
+}
 
-		topicSplit := strings.Split(sensor.Topic, "/")
+/**
+ * Function that publish again the configs of the entities already announced, on each (re)connection
+ */
+func republishDiscovery() {
+	for topic, item := range discoveryCache.Items() {
+		mqttPublish(topic, 1, true, item.Object.(string))
+	}
+}
 
-		jsonString = "{ \"tc\": \"" + timecodeString
-		jsonString = jsonString + "\" , \"n\": \"" + topicSplit[1]
-		jsonString = jsonString + "\" , \"r\": \"" + sensor.Ref
-		jsonString = jsonString + "\" , \"q\": \"" + qualifierString
-		jsonString = jsonString + "\" , \"ftamper\": \"" + testBit(m[19], 0)    // tamper flag
-		jsonString = jsonString + "\" , \"fanomaly\": \"" + testBit(m[19], 1)   // anomaly flag
-		jsonString = jsonString + "\" , \"flowbatt\": \"" + testBit(m[19], 2)   // low batt flag
-		jsonString = jsonString + "\" , \"ftestassoc\": \"" + testBit(m[19], 4) // test assoc flag
-		jsonString = jsonString + "\" , \"fdomestic\": \"" + testBit(m[19], 5)  // domestic frame flag
-		jsonString = jsonString + "\" , \"st\": \"" + sensor.SubType
-		jsonString = jsonString + "\" }"
+/**
+ * Function that publish a decoded reading, directly or through the batch
+ */
+func publishReading(t string, d string) {
+	if atomic.LoadInt32(&paused) == 1 {
+		log.Debug("Gateway paused, reading not published on ", t)
+		return
+	}
 
-	case infosType11:
-		log.Debug(", X2D Shutter")
-		log.Debug(", SubType=", binary.LittleEndian.Uint16(m[13:]))
-		log.Debug(", id=", binary.LittleEndian.Uint32(m[15:]))
-		log.Debug(", qualifier=", binary.LittleEndian.Uint16(m[19:]))
-		log.Debug(", reserved1=", binary.LittleEndian.Uint16(m[21:]))
-		log.Debug(", reserved2=", binary.LittleEndian.Uint16(m[23:]))
-		log.Debug(", data[4]=", binary.LittleEndian.Uint16(m[25:]))
+	if conf.GetBool("brockermqtt.resyncretained") {
+		lastPublishedCache.Set(t, d, cache.NoExpiration)
+	}
 
-		sensor.Ref = "11-" + strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[15:])), 10)
-		sensor.Protocol = "X2D"
-		sensor.SubType = strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[13:])), 10)
-		sensor.Name = sensorName(sensor.Ref)
-		sensor.Topic = sensorTopic(sensor.Ref)
-		if sensor.Topic == "NULL" {
-			sensor.Topic = conf.GetString("brokermqtt.topicroot") + "/" + sensor.Ref + "/x2dshutter"
+	if conf.GetString("sink.type") == "stdout" {
+		fmt.Fprintln(os.Stdout, d)
+		return
+	}
+
+	if conf.GetString("sink.type") == "webhook" {
+		select {
+		case webhookQueue <- d:
+		default:
+			log.Warn("Webhook queue full, reading of ", t, " dropped")
 		}
-		log.Debug(", topic=", sensor.Topic)
+		return
+	}
 
-		qualifierString := strconv.FormatUint(uint64(binary.LittleEndian.Uint16(m[19:])), 10)
+	if conf.GetInt("brockermqtt.batchwindow") > 0 {
+		addToBatch(t, d)
+		if !conf.GetBool("brockermqtt.batchkeeptopics") {
+			return
+		}
+	}
 
-		log.Debug(", topic=", sensor.Topic)
+	options := readingOptions(t)
+	go publishMessage(t, options.QoS, options.Retain, d)
+}
 
-		topicSplit := strings.Split(sensor.Topic, "/")
+/**
+ * Function that publish again the last reading of each topic, to restore them after a broker restart
+ */
+func resyncReadings() {
+	items := lastPublishedCache.Items()
+	log.Info("[MQTT] Resync of the last ", len(items), " readings")
 
-		jsonString = "{ \"tc\": \"" + timecodeString
-		jsonString = jsonString + "\" , \"n\": \"" + topicSplit[1]
-		jsonString = jsonString + "\" , \"r\": \"" + sensor.Ref
-		jsonString = jsonString + "\" , \"q\": \"" + qualifierString
-		jsonString = jsonString + "\" , \"ftamper\": \"" + testBit(m[19], 0)    // tamper flag
-		jsonString = jsonString + "\" , \"fanomaly\": \"" + testBit(m[19], 1)   // anomaly flag
-		jsonString = jsonString + "\" , \"flowbatt\": \"" + testBit(m[19], 2)   // low batt flag
-		jsonString = jsonString + "\" , \"ftestassoc\": \"" + testBit(m[19], 4) // test assoc flag
-		jsonString = jsonString + "\" , \"fdomestic\": \"" + testBit(m[19], 5)  // domestic frame flag
-		jsonString = jsonString + "\" , \"st\": \"" + sensor.SubType
-		jsonString = jsonString + "\" }"
+	for t, item := range items {
+		options := readingOptions(t)
+		publishMessage(t, options.QoS, options.Retain, item.Object.(string))
+	}
+}
 
-	case infosType12:
-		log.Debug(", deprecated")
-		log.Debug(", SubType=", binary.LittleEndian.Uint16(m[13:]))
-		log.Debug(", id=", binary.LittleEndian.Uint32(m[15:]))
-		log.Debug(", qualifier=", binary.LittleEndian.Uint16(m[19:]))
-		log.Debug(", temp=", (int16)(binary.LittleEndian.Uint16(m[21:])))
-		log.Debug(", setPoint=", (int16)(binary.LittleEndian.Uint16(m[23:])))
+/**
+ * Function that post the readings of the queue to sink.url, one request per reading
+ * A failed request is logged and the reading dropped
+ */
+func webhookSender() {
+	client := &http.Client{Timeout: time.Duration(conf.GetInt("sink.timeout")) * time.Millisecond}
 
-		sensor.Ref = "12-" + strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[15:])), 10)
-		sensor.Protocol = "DEPRECATED"
-		sensor.SubType = strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[13:])), 10)
-		sensor.Name = sensorName(sensor.Ref)
-		sensor.Topic = sensorTopic(sensor.Ref)
-		if sensor.Topic == "NULL" {
-			sensor.Topic = conf.GetString("brokermqtt.topicroot") + "/" + sensor.Ref + "/null"
+	for d := range webhookQueue {
+		req, err := http.NewRequest(conf.GetString("sink.method"), conf.GetString("sink.url"), strings.NewReader(d))
+		if err != nil {
+			log.Error("[WEBHOOK] Unable to build request: ", err)
+			continue
+		}
+		req.Header.Set("Content-Type", "application/json")
+		for k, v := range conf.GetStringMapString("sink.headers") {
+			req.Header.Set(k, v)
 		}
-		log.Debug(", topic=", sensor.Topic)
 
-		qualifierString := strconv.FormatUint(uint64(binary.LittleEndian.Uint16(m[19:])), 10)
+		resp, err := client.Do(req)
+		if err != nil {
+			log.Error("[WEBHOOK] Request failed, reading dropped: ", err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Error("[WEBHOOK] Request failed with status ", resp.Status, ", reading dropped")
+		}
+	}
+}
 
-		topicSplit := strings.Split(sensor.Topic, "/")
+/**
+ * Function that add a reading to the batch, flushed when batchsize is reached
+ */
+func addToBatch(t string, d string) {
+	batchLock.Lock()
+	batch = append(batch, batchItem{Topic: t, Payload: json.RawMessage(d)})
+	full := len(batch) >= conf.GetInt("brockermqtt.batchsize")
+	batchLock.Unlock()
+
+	if full {
+		flushBatch()
+	}
+}
 
-		jsonString = "{ \"tc\": \"" + timecodeString
-		jsonString = jsonString + "\" , \"n\": \"" + topicSplit[1]
-		jsonString = jsonString + "\" , \"r\": \"" + sensor.Ref
-		jsonString = jsonString + "\" , \"q\": \"" + qualifierString
-		jsonString = jsonString + "\" , \"st\": \"" + sensor.SubType
-		jsonString = jsonString + "\" }"
+/**
+ * Function that publish all the readings of the batch as a JSON array on the batch topic
+ */
+func flushBatch() {
+	batchLock.Lock()
+	items := batch
+	batch = nil
+	batchLock.Unlock()
+
+	if len(items) == 0 {
+		return
+	}
 
-	case infosType13:
-		log.Debug(", Linky")
-		log.Debug(", SubType=", binary.LittleEndian.Uint16(m[13:]))
-		log.Debug(", id=", binary.LittleEndian.Uint32(m[15:]))
-		log.Debug(", qualifier=", binary.LittleEndian.Uint16(m[19:]))
-		log.Debug(", contractType=", binary.LittleEndian.Uint16(m[21:]))
-		log.Debug(", setPoint=", (int16)(binary.LittleEndian.Uint16(m[23:])))
-		log.Debug(", cnt1=", binary.LittleEndian.Uint32(m[25:]))
-		log.Debug(", cnt2=", binary.LittleEndian.Uint32(m[29:]))
-		log.Debug(", apparentPower=", binary.LittleEndian.Uint16(m[33:]))
+	payload, err := json.Marshal(items)
+	if err != nil {
+		log.Error("[BATCH] Unable to build batch of ", len(items), " readings: ", err)
+		return
+	}
 
-		sensor.Ref = "13-" + strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[15:])), 10)
-		sensor.Protocol = "LINKY"
-		sensor.SubType = strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[13:])), 10)
-		sensor.Name = sensorName(sensor.Ref)
-		sensor.Topic = sensorTopic(sensor.Ref)
-		if sensor.Topic == "NULL" {
-			sensor.Topic = conf.GetString("brokermqtt.topicroot") + "/" + sensor.Ref + "/linky"
-		}
-		log.Debug(", topic=", sensor.Topic)
+	topic := conf.GetString("brockermqtt.batchtopic")
+	if topic == "" {
+		topic = brokerTopicRoot() + "/batch"
+	}
 
-		contracttypeString := strconv.FormatUint(uint64(binary.LittleEndian.Uint16(m[21:])), 10)
-		setpointString := strconv.FormatUint(uint64(binary.LittleEndian.Uint16(m[23:])), 10)
-		cnt1String := strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[25:])), 10)
-		cnt2String := strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[29:])), 10)
-		apparentpowerString := strconv.FormatUint(uint64(binary.LittleEndian.Uint16(m[33:])), 10)
-		qualifierString := strconv.FormatUint(uint64(binary.LittleEndian.Uint16(m[19:])), 10)
+	log.Debug("[BATCH] Publishing ", len(items), " readings on ", topic)
+	go publish(topic, string(payload))
+}
+
+/**
+ * Function that flush the batch every batchwindow milliseconds
+ */
+func batchFlusher() {
+	for {
+		time.Sleep(time.Duration(conf.GetInt("brockermqtt.batchwindow")) * time.Millisecond)
+		flushBatch()
+	}
+}
 
-		topicSplit := strings.Split(sensor.Topic, "/")
+/**
+ * Function the publish a MQTT message with topic t and message d
+ */
+func publish(t string, d string) {
+	publishMessage(t, 2, false, d)
+}
 
-		jsonString = "{ \"tc\": \"" + timecodeString
-		jsonString = jsonString + "\" , \"n\": \"" + topicSplit[1]
-		jsonString = jsonString + "\" , \"r\": \"" + sensor.Ref
-		jsonString = jsonString + "\" , \"ct\": \"" + contracttypeString
-		jsonString = jsonString + "\" , \"sp\": \"" + setpointString
-		jsonString = jsonString + "\" , \"cnt1\": \"" + cnt1String
-		jsonString = jsonString + "\" , \"cnt2\": \"" + cnt2String
-		jsonString = jsonString + "\" , \"ap\": \"" + apparentpowerString
-		jsonString = jsonString + "\" , \"q\": \"" + qualifierString
-		jsonString = jsonString + "\" , \"st\": \"" + sensor.SubType
-		jsonString = jsonString + "\" }"
+/**
+ * Function the publish a MQTT message with topic t and message d, with a given QoS and retain flag
+ */
+func publishMessage(t string, qos byte, retain bool, d string) {
+	mqttPublish(gatewayTopic(t), qos, retain, d)
+}
 
-	case infosType14:
-		log.Debug(", FS20")
-		log.Debug(", SubType=", binary.LittleEndian.Uint16(m[13:]))
-		log.Debug(", id=", binary.LittleEndian.Uint32(m[15:]))
-		log.Debug(", qualifier=", binary.LittleEndian.Uint16(m[19:]))
+/**
+ * Function the publish a MQTT message on the topic t as is, without the gateway prefix
+ */
+func mqttPublish(t string, qos byte, retain bool, d string) {
+	var token mqtt.Token
 
-		sensor.Ref = "14-" + strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[15:])), 10)
-		sensor.Protocol = "FS20"
-		sensor.SubType = strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[13:])), 10)
-		sensor.Name = sensorName(sensor.Ref)
-		sensor.Topic = sensorTopic(sensor.Ref)
-		if sensor.Topic == "NULL" {
-			sensor.Topic = conf.GetString("brokermqtt.topicroot") + "/" + sensor.Ref + "/fs20"
+	if cmqtt != nil && cmqtt.IsConnectionOpen() {
+		token = cmqtt.Publish(t, qos, retain, d)
+		if token.Wait() && token.Error() == nil {
+			metricMqttPublished.Inc()
 		}
-		log.Debug(", topic=", sensor.Topic)
-
-		qualifierString := strconv.FormatUint(uint64(binary.LittleEndian.Uint16(m[19:])), 10)
+	}
+}
 
-		topicSplit := strings.Split(sensor.Topic, "/")
+/**
+ * Function that send the initialisation commands of config.yml to the dongle
+ * - Wait rfplayer.initdelay ms before the first command, a dongle just powered on can ignore it
+ * - With rfplayer.initwaitack, wait for an ASCII response up to rfplayer.initacktimeout ms
+ *   and send the command again up to rfplayer.initretries times
+ */
+func sendInitialisation(p io.Writer) {
+	time.Sleep(time.Duration(conf.GetInt("rfplayer.initdelay")) * time.Millisecond)
 
-		jsonString = "{ \"tc\": \"" + timecodeString
-		jsonString = jsonString + "\" , \"n\": \"" + topicSplit[1]
-		jsonString = jsonString + "\" , \"r\": \"" + sensor.Ref
-		jsonString = jsonString + "\" , \"q\": \"" + qualifierString
-		jsonString = jsonString + "\" , \"st\": \"" + sensor.SubType
-		jsonString = jsonString + "\" }"
+	waitAck := conf.GetBool("rfplayer.initwaitack")
+	if waitAck && !conf.GetBool("rfplayer.rx") {
+		log.Warn("rfplayer.initwaitack needs rfplayer.rx, initialisation commands sent without waiting")
+		waitAck = false
+	}
+	timeout := time.Duration(conf.GetInt("rfplayer.initacktimeout")) * time.Millisecond
 
-	case infosType15:
-		log.Debug(", JAMMING")
-		log.Debug(", SubType=", binary.LittleEndian.Uint16(m[13:]))
-		log.Debug(", Id=", binary.LittleEndian.Uint32(m[15:]))
+	atomic.StoreInt32(&initRunning, 1)
+	defer atomic.StoreInt32(&initRunning, 0)
 
-		sensor.Ref = "15-" + strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[15:])), 10)
-		sensor.Protocol = "JAMMING"
-		sensor.SubType = strconv.FormatUint(uint64(binary.LittleEndian.Uint32(m[13:])), 10)
-		sensor.Name = sensorName(sensor.Ref)
-		sensor.Topic = sensorTopic(sensor.Ref)
-		if sensor.Topic == "NULL" {
-			sensor.Topic = conf.GetString("brokermqtt.topicroot") + "/" + sensor.Ref + "/jamming"
-		}
-		log.Debug(", topic=", sensor.Topic)
+	for i := 0; i < len(config.Rfplayer.Initialisation); i++ {
+		tData := []byte(config.Rfplayer.Initialisation[i].Cmd + "\x00")
 
-		subtypeString := strconv.FormatUint(uint64(binary.LittleEndian.Uint16(m[13:])), 10)
+		for try := 0; try <= conf.GetInt("rfplayer.initretries"); try++ {
+			// Forget a late response of the previous command
+			select {
+			case <-initAcks:
+			default:
+			}
 
-		topicSplit := strings.Split(sensor.Topic, "/")
+			count, err := writeSerial(p, tData)
+			if err != nil {
+				log.Error("Error writing to serial port: ", err)
+				break
+			}
+			log.Debug("Wrote ", count, " bytes : ", string(tData[:]))
 
-		jsonString = "{ \"tc\": \"" + timecodeString
-		jsonString = jsonString + "\" , \"n\": \"" + topicSplit[1]
-		jsonString = jsonString + "\" , \"r\": \"" + sensor.Ref
-		jsonString = jsonString + "\" , \"s\": \"" + subtypeString
-		jsonString = jsonString + "\" , \"st\": \"" + sensor.SubType
-		jsonString = jsonString + "\" }"
+			if !waitAck {
+				break
+			}
 
+			select {
+			case response := <-initAcks:
+				log.Debug("Initialisation command ", config.Rfplayer.Initialisation[i].Cmd, " acknowledged : ", response)
+			case <-time.After(timeout):
+				log.Warn("No response to initialisation command ", config.Rfplayer.Initialisation[i].Cmd, " (try ", try+1, ")")
+				continue
+			}
+			break
+		}
 	}
+}
 
-	/**
-	 * Send the MQTT message in non blocking way
-	 */
-	log.Debug("Publication MQTT jsonString : ", jsonString)
-	go publish(sensor.Topic, jsonString)
+/**
+ * Function that return the serial port of the dongle, replaced by serialReopen once reopened
+ */
+func serialPort() io.ReadWriteCloser {
+	rfpPortLock.Lock()
+	defer rfpPortLock.Unlock()
+
+	return rfpPort
 }
 
 /**
- * Function the publish a MQTT message with topic t and message d
+ * Function that replace the serial port of the dongle
  */
-func publish(t string, d string) {
-	var token mqtt.Token
+func setSerialPort(p io.ReadWriteCloser) {
+	rfpPortLock.Lock()
+	defer rfpPortLock.Unlock()
+
+	rfpPort = p
+}
+
+/**
+ * Function that write a byte array to the serial port in chunks of rfplayer.writechunksize bytes
+ * separated by rfplayer.writechunkdelay milliseconds. A chunk size of 0 means a single write
+ */
+func writeSerial(p io.Writer, d []byte) (int, error) {
+	size := conf.GetInt("rfplayer.writechunksize")
+	if size <= 0 || size >= len(d) {
+		return p.Write(d)
+	}
+
+	delay := time.Duration(conf.GetInt("rfplayer.writechunkdelay")) * time.Millisecond
+	written := 0
+	for written < len(d) {
+		end := written + size
+		if end > len(d) {
+			end = len(d)
+		}
+
+		n, err := p.Write(d[written:end])
+		written = written + n
+		if err != nil {
+			return written, err
+		}
 
-	if cmqtt.IsConnectionOpen() {
-		token = cmqtt.Publish(t, 2, false, d)
-		token.Wait()
+		if written < len(d) {
+			time.Sleep(delay)
+		}
 	}
+
+	return written, nil
 }
 
 /**
  * Function that send a byte array to the serial port of RFPLayer module
+ * The port is given by port() at each message, serialReopen may have replaced it
  */
-func emit(p io.ReadWriteCloser) {
+func emit(port func() io.ReadWriteCloser) {
 	var n int
 	var err error
 
@@ -1017,15 +2795,28 @@ func emit(p io.ReadWriteCloser) {
 		 * Send the message in the buffered channel
 		 */
 		log.Debug(time.Now(), " : wait for message")
-		n, err = p.Write(<-ch)
+		c := <-ch
+		if atomic.LoadInt32(&serialUp) == 0 {
+			publishAck(c.Name, fmt.Errorf("not ready: serial port closed"))
+			atomic.AddInt32(&emitting, -1)
+			continue
+		}
+		n, err = writeSerial(port(), c.Frame)
 		if err != nil {
 			if err != io.EOF {
 				log.Error("Error writing to serial port: ", err)
+				reportSerialLost(err)
 			}
 		} else {
 			log.Debug(time.Now(), " : ", n, " bytes wrote")
 		}
 
+		/**
+		 * Tell the sender if the command was written to the dongle
+		 */
+		publishAck(c.Name, err)
+		atomic.AddInt32(&emitting, -1)
+
 		/**
 		 * Sleep iWait2Send not to block rfp1000 dongle
 		 */
@@ -1033,6 +2824,163 @@ func emit(p io.ReadWriteCloser) {
 	}
 }
 
+/**
+ * Function that queue a command for emit
+ * emitting is incremented before the command is in the channel, so that it is counted until written
+ */
+func queueCommand(c command) {
+	atomic.AddInt32(&emitting, 1)
+	ch <- c
+}
+
+/**
+ * Function that wait for the queued commands to be written to the serial port, return false on timeout
+ */
+func waitCommandsSent(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt32(&emitting) > 0 {
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return true
+}
+
+/**
+ * Function that stop the gateway on SIGINT or SIGTERM
+ * - The commands already queued are written to the dongle, for 5 seconds at most
+ * - The pending batch and the offline status are published, then MQTT is disconnected
+ * - The serial port is closed, not to stay locked
+ */
+func shutdown(sig os.Signal) {
+	log.Info("Signal ", sig, " received, stopping...")
+	atomic.StoreInt32(&stopping, 1)
+
+	if !waitCommandsSent(5 * time.Second) {
+		log.Warn(atomic.LoadInt32(&emitting), " commands not sent")
+	}
+
+	if cmqtt != nil && cmqtt.IsConnectionOpen() {
+		flushBatch()
+		publishMessage(statusTopic(), 1, true, conf.GetString("brockermqtt.statusoffline"))
+		publishActuatorsAvailability()
+		cmqtt.Disconnect(250)
+	}
+
+	if p := serialPort(); p != nil {
+		p.Close()
+	}
+
+	saveTICCounters() // Last values, to detect a rollover while stopped
+
+	if pidFile != "" {
+		os.Remove(pidFile)
+	}
+
+	log.Info("Stopped")
+	os.Exit(0)
+}
+
+/**
+ * Prefix of rfplayer.port for the simulation mode, followed by the path of a file of frames, or nothing
+ */
+const simPortScheme = "sim://"
+
+/**
+ * Port of the simulation mode, replacing the dongle for developing and replaying captures
+ * The frames of the file, then the ones injected on <topicroot>/sim/frames, are read by receive as serial bytes
+ * The commands written are only logged
+ */
+type simPort struct {
+	reader *io.PipeReader
+	writer *io.PipeWriter
+}
+
+/**
+ * Function that open the simulation port, and replay the frames of the file path if not empty
+ * The file holds a frame in hexadecimal per line, header ZI included as the raw field of the unknown frames,
+ * the empty lines and the lines starting with # are skipped. The frames are spaced by rfplayer.simdelay
+ */
+func openSimPort(path string) (*simPort, error) {
+	var f *os.File
+
+	if path != "" {
+		var err error
+		if f, err = os.Open(path); err != nil {
+			return nil, err
+		}
+	}
+
+	r, w := io.Pipe()
+	p := &simPort{reader: r, writer: w}
+
+	if f != nil {
+		go func() {
+			defer f.Close()
+
+			delay := time.Duration(conf.GetInt("rfplayer.simdelay")) * time.Millisecond
+			scanner := bufio.NewScanner(f)
+			line := 0
+			for scanner.Scan() {
+				line++
+				frame := strings.TrimSpace(scanner.Text())
+				if frame == "" || strings.HasPrefix(frame, "#") {
+					continue
+				}
+
+				time.Sleep(delay)
+				if err := p.inject(frame); err != nil {
+					log.Warn("[SIM] Line ", line, " of ", path, " ignored : ", err)
+				}
+			}
+			log.Info("[SIM] ", line, " lines of ", path, " replayed")
+		}()
+	}
+
+	return p, nil
+}
+
+/**
+ * Function that feed a frame in hexadecimal to receive
+ */
+func (p *simPort) inject(frame string) error {
+	b, err := hex.DecodeString(strings.ReplaceAll(frame, " ", ""))
+	if err != nil {
+		return fmt.Errorf("invalid hexadecimal frame: %s", err)
+	}
+
+	_, err = p.writer.Write(b)
+	return err
+}
+
+func (p *simPort) Read(b []byte) (int, error) {
+	return p.reader.Read(b)
+}
+
+func (p *simPort) Write(b []byte) (int, error) {
+	log.Info("[SIM] Frame not sent : ", hex.EncodeToString(b))
+	return len(b), nil
+}
+
+func (p *simPort) Close() error {
+	p.writer.Close()
+	return p.reader.Close()
+}
+
+/**
+ * Function that handle MQTT message on <topicroot>/sim/frames, a frame in hexadecimal to decode as if received
+ * Only subscribed in simulation mode, the result is published on <topicroot>/sim/frames/result
+ */
+var fSimFrameHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
+	err := simFrames.inject(strings.TrimSpace(string(msg.Payload())))
+	if err != nil {
+		log.Warn("[SIM] Frame ignored : ", err)
+	}
+	publishResult(brokerTopicRoot()+"/sim/frames/result", err)
+}
+
 /**
  * Function that handle a stream of bytes from RFPlayer dongle
  */
@@ -1047,9 +2995,19 @@ func receive(p io.ReadWriteCloser) {
 		if err != nil {
 			if err != io.EOF {
 				log.Error("++++++> Error reading from serial port: ", err)
+
+				/**
+				 * Let serialReopen handle the port, a new receive will be launched once reopened
+				 */
+				reportSerialLost(err)
+				return
 			}
 		}
 
+		if n > 0 {
+			atomic.StoreInt64(&lastBytesTime, time.Now().Unix())
+		}
+
 		/**
 		 * Append to spool
 		 */
@@ -1064,37 +3022,65 @@ func receive(p io.ReadWriteCloser) {
 		lspool = lspool + n
 
 		/**
-		 * Transfer in a byte array
+		 * Extract all the complete frames of the spool before reading again
+		 * A single read can hold several frames when they arrive back-to-back
 		 */
-		spoolbytes := spool.Bytes()
+		for lspool > 0 {
+			/**
+			 * Transfer in a byte array
+			 */
+			spoolbytes := spool.Bytes()
 
-		/**
-		 * Look for 'ZI' which is start of message
-		 */
-		i := bytes.Index(spoolbytes, []byte("ZI"))
+			/**
+			 * Look for 'ZI' which is start of message
+			 */
+			i := bytes.Index(spoolbytes, []byte("ZI"))
 
-		/**
-		 * If 'ZI' found
-		 */
-		if i != -1 {
 			/**
-			 * Is there enough bytes to compute the payload length
+			 * If 'ZI' found
 			 */
-			if i+4 < lspool {
+			if i != -1 {
 				/**
-				 * Display source-dest value
+				 * ASCII frame, ended by a CR, LF or NUL character
 				 */
-				//log.Info("SourceDest value : ", (int)(spoolbytes[i+2]))
+				if i+2 < lspool && spoolbytes[i+2]&asciiContainerMask != 0 {
+					j := bytes.IndexAny(spoolbytes[i:], "\r\n\x00")
+					if j == -1 {
+						break
+					}
 
-				/**
-				 * Extract the length of payload
-				 */
-				payloadlen := (int)(spoolbytes[i+3]) + ((int)(spoolbytes[i+4]) * 256)
+					/**
+					 * Discard unusefull bytes at beginning and extract the frame with its ending character
+					 */
+					spool.Next(i)
+					lspool = lspool - i
+					message := spool.Next(j + 1)
+					lspool = lspool - (j + 1)
+
+					atomic.StoreInt64(&lastFrameTime, time.Now().Unix())
+					atomic.AddUint64(&framesReceived, 1)
+					decodeASCII(message[:j])
+				} else if i+4 < lspool {
+					/**
+					 * Is there enough bytes to compute the payload length
+					 */
+					/**
+					 * Display source-dest value
+					 */
+					//log.Info("SourceDest value : ", (int)(spoolbytes[i+2]))
+
+					/**
+					 * Extract the length of payload
+					 */
+					payloadlen := (int)(spoolbytes[i+3]) + ((int)(spoolbytes[i+4]) * 256)
+
+					/**
+					 * Message complete in spool ? It starts at 'ZI', after i unusefull bytes
+					 */
+					if i+payloadlen+5 > lspool {
+						break
+					}
 
-				/**
-				 * Message complete in spool ?
-				 */
-				if payloadlen+5 <= lspool {
 					/**
 					 * Discard unusefull bytes at beginning
 					 */
@@ -1111,25 +3097,69 @@ func receive(p io.ReadWriteCloser) {
 					 * Send to decode
 					 */
 					log.Debug("Message to decode -->", string(message[:payloadlen+5]), "<-- ")
+					atomic.StoreInt64(&lastFrameTime, time.Now().Unix())
+					atomic.AddUint64(&framesReceived, 1)
 					decode(payloadlen+5, message[:payloadlen+5])
+				} else {
+					break
 				}
+			} else {
+				/**
+				 * Start message not found. If length in spool bigger than 64 bytes, discard spool and log it in Error
+				 * As a message should be 28 bytes long maximum, we get an extra space before discarding
+				 */
+				spool.Next(lspool)
+				lspool = 0
+				logNoSync()
 			}
-		} else {
-			/**
-			 * Start message not found. If length in spool bigger than 64 bytes, discard spool and log it in Error
-			 * As a message should be 28 bytes long maximum, we get an extra space before discarding
-			 */
-			spool.Next(lspool)
-			lspool = 0
-			log.Error("++++++> Error, no 'ZI' found in the spool buffer")
 		}
 	}
 }
 
+/**
+ * Function that log the spool buffers discarded without 'ZI' at most once per rfplayer.nosynclogperiod seconds
+ * Noise or a wrong baud rate would otherwise flood the logs
+ */
+func logNoSync() {
+	noSyncCount++
+	metricFramesRejected.WithLabelValues("nosync").Inc()
+
+	if time.Since(noSyncLog) < time.Duration(conf.GetInt("rfplayer.nosynclogperiod"))*time.Second {
+		return
+	}
+
+	log.Error("++++++> Error, no 'ZI' found in the spool buffer (", noSyncCount, " times), check the baud rate of the serial port (rfplayer.baud)")
+	noSyncCount = 0
+	noSyncLog = time.Now()
+}
+
+/**
+ * Function that return the dim level of a dim:<level> command, from 0 to 100 %
+ * The level is given from 0 to actions.brightnessscale, 255 for the brightness of Home Assistant
+ * Only the CHACON (DIO) dimmers take a level, the other protocols would ignore or misread it
+ */
+func dimLevel(name string, v string) (int, error) {
+	if !dimmableProtocols[actuatorProtocol(name)] {
+		return -1, fmt.Errorf("dim not supported: %s is a %s actuator", name, actuatorProtocol(name))
+	}
+
+	scale := conf.GetInt("actions.brightnessscale")
+	if scale <= 0 {
+		scale = 100
+	}
+
+	level, err := strconv.Atoi(v)
+	if err != nil || level < 0 || level > scale {
+		return -1, fmt.Errorf("invalid dim level: %s, expected 0 to %d", v, scale)
+	}
+
+	return (level*100 + scale/2) / scale, nil
+}
+
 /**
  * Function that handle MQTT message related to "subscribe"
  *
- * - The commands passed by MQTT messages : home/action/...
+ * - The commands passed by MQTT messages : home/action/... or home/action/<protocol>/...
  *   as exemple to close shutter : home/action/<nom_volet> payload down
  * 			       appairing a DIO plug : home/action/<plug_name> payload assoc
  *				   set on DIO plug : home/action/<plug_name> payload on
@@ -1139,16 +3169,83 @@ var fMqttMsgHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Mess
 	b := new(bytes.Buffer)
 
 	log.Debug(time.Now(), " --- fMqttMsgHandler TOPIC: ", msg.Topic(), " MSG: ", msg.Payload(), " - l : ", cap(msg.Payload()))
+	metricCommandsReceived.Inc()
+
+	configLock.RLock() // The caches of the actuators are not rebuilt while the command is handled
+	defer configLock.RUnlock()
+
+	if atomic.LoadInt32(&paused) == 1 {
+		log.Info("Gateway paused, command ignored on ", msg.Topic())
+		return
+	}
+
+	if atomic.LoadInt32(&stopping) == 1 {
+		log.Info("Gateway stopping, command ignored on ", msg.Topic())
+		return
+	}
 
 	/**
 	 * Split on char /
 	 */
-	topicSplit := strings.Split(string(msg.Topic()), "/")
+	topicSplit := strings.Split(strings.TrimPrefix(msg.Topic(), gatewayTopic("")), "/")
 
 	/**
-	 * Deal with a command if topic is like home/action
+	 * Deal with a command if topic is like home/action/<name> or home/action/<protocol>/<name>
 	 */
-	if topicSplit[0] == "home" && topicSplit[1] == "action" && len(topicSplit[2]) > 0 {
+	if (len(topicSplit) == 3 || len(topicSplit) == 4) && topicSplit[0] == "home" && topicSplit[1] == "action" && len(topicSplit[len(topicSplit)-1]) > 0 {
+		name := topicSplit[len(topicSplit)-1]
+
+		/**
+		 * Reject the commands for an actuator not defined in config
+		 */
+		if actuatorID(name) == "NULL" || actuatorProtocol(name) == "NULL" {
+			n := atomic.AddUint64(&unknownActuatorCommands, 1)
+			log.Warn("Command for unknown actuator ", name, " (", n, " commands rejected)")
+			publishAck(name, fmt.Errorf("unknown actuator: %s", name))
+			return
+		}
+
+		/**
+		 * The protocol of a per-protocol topic must be the one of the actuator, for the broker ACLs to be meaningful
+		 */
+		if len(topicSplit) == 4 && canonicalProtocol(topicSplit[2]) != actuatorProtocol(name) {
+			log.Warn("Command for ", name, " rejected : protocol ", topicSplit[2], " instead of ", actuatorProtocol(name))
+			publishAck(name, fmt.Errorf("protocol mismatch: %s is a %s actuator", name, actuatorProtocol(name)))
+			return
+		}
+
+		/**
+		 * Reject the commands while the dongle is not ready, a retained command would be lost
+		 */
+		if err := commandsReady(); err != nil {
+			log.Warn("Command for ", name, " rejected : ", err)
+			publishAck(name, err)
+			return
+		}
+
+		/**
+		 * Protect the RF medium from a runaway automation
+		 */
+		if !commandAllowed() {
+			log.Warn("Too many commands, command for ", name, " dropped")
+			publishAck(name, fmt.Errorf("rate limited: more than %d commands per second", conf.GetInt("rfplayer.maxcommandspersecond")))
+			return
+		}
+
+		/**
+		 * A payload dim:<0-100> is a DIM action with its level, only for the protocols supporting it
+		 */
+		payload := string(msg.Payload())
+		dim := -1
+		if strings.HasPrefix(payload, "dim:") {
+			var err error
+			if dim, err = dimLevel(name, strings.TrimPrefix(payload, "dim:")); err != nil {
+				log.Warn("Command for ", name, " rejected : ", err)
+				publishAck(name, err)
+				return
+			}
+			payload = "2"
+		}
 
 		/**
 		 * Add header
@@ -1156,9 +3253,9 @@ var fMqttMsgHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Mess
 		b.Write([]byte("ZI")) // ZI
 
 		/**
-		 * Add sourdest value, \x01 for 433/868
+		 * Add sourdest value, \x01 for 433/868 by default
 		 */
-		b.Write([]byte("\x01"))
+		b.WriteByte(actuatorSourceDest(name))
 
 		/**
 		 * Add the length of the message (12 for the moment)
@@ -1174,12 +3271,12 @@ var fMqttMsgHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Mess
 		/**
 		 * Configure the protocol variable from the conf of the actuator and add it to buffer
 		 */
-		switch actuatorProtocol(topicSplit[2]) {
+		switch actuatorProtocol(name) {
 		case "visonic433":
 			b.Write([]byte("\x01"))
 		case "visonic868":
 			b.Write([]byte("\x02"))
-		case "chacon", "dio":
+		case "chacon":
 			b.Write([]byte("\x03"))
 		case "domia":
 			b.Write([]byte("\x04"))
@@ -1195,7 +3292,7 @@ var fMqttMsgHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Mess
 			b.Write([]byte("\x09"))
 		case "x2dhagas":
 			b.Write([]byte("\x0A"))
-		case "somfyrts", "rts":
+		case "somfyrts":
 			b.Write([]byte("\x0B"))
 		case "blyss":
 			b.Write([]byte("\x0C"))
@@ -1209,9 +3306,9 @@ var fMqttMsgHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Mess
 			b.Write([]byte("\x10"))
 		}
 
-		switch actuatorProtocol(topicSplit[2]) {
-		case "visonic433", "visonic868", "chacon", "dio", "domia", "x10", "x2d433", "x2d868", "x2dshutter", "x2dhagas", "somfyrts", "rts", "blyss", "parrot", "fs20", "kd101", "edisio":
-			switch string(msg.Payload()) {
+		switch actuatorProtocol(name) {
+		case "visonic433", "visonic868", "chacon", "domia", "x10", "x2d433", "x2d868", "x2dshutter", "x2dhagas", "somfyrts", "blyss", "parrot", "fs20", "kd101", "edisio":
+			switch payload {
 			case "0": // OFF
 				b.Write([]byte("\x00"))
 			case "1": // ON
@@ -1221,67 +3318,472 @@ var fMqttMsgHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Mess
 			case "6": // ASSOC
 				b.Write([]byte("\x06"))
 			default:
-				log.Debug(time.Now(), " --- fMqttMsgHandler : Unknown payload : ", string(msg.Payload()))
+				log.Debug(time.Now(), " --- fMqttMsgHandler : Unknown payload : ", payload)
 			}
 		case "x2dhaelec":
-			log.Debug(time.Now(), " --- fMqttMsgHandler : in X2DHAELEC with payload : ", string(msg.Payload()))
-			switch string(msg.Payload()) {
+			log.Debug(time.Now(), " --- fMqttMsgHandler : in X2DHAELEC with payload : ", payload)
+			switch payload {
 			case "AutoLow", "EcoLow", "ConfortLow": // => OFF
 				b.Write([]byte("\x00"))
 			case "Auto", "Eco", "Confort", "Stop", "HorsGel": // => ON
 				b.Write([]byte("\x01"))
 			default:
-				log.Debug(time.Now(), " --- fMqttMsgHandler : Unknown payload : ", string(msg.Payload()))
+				log.Debug(time.Now(), " --- fMqttMsgHandler : Unknown payload : ", payload)
 			}
 		default:
-			log.Debug(time.Now(), " --- fMqttMsgHandler : unknown protocol ", actuatorProtocol(topicSplit[2]))
+			log.Debug(time.Now(), " --- fMqttMsgHandler : unknown protocol ", actuatorProtocol(name))
 		}
 
 		/**
 		 * Get the code with the name of the actuator
 		 */
-		h := atobDeviceID(actuatorID(topicSplit[2])) // DeviceID 4 bytes LSB First
+		h := atobDeviceID(actuatorID(name)) // DeviceID 4 bytes LSB First
 		a := make([]byte, 4)
 		binary.LittleEndian.PutUint32(a, h)
 		b.Write(a)
 
-		switch actuatorProtocol(topicSplit[2]) {
-		case "visonic433", "dio", "chacon":
-			b.Write([]byte("\x00")) // DimValue 0% to 100%
-		case "somfyrts", "rts":
-			if string(msg.Payload()) != "2" {
-				b.Write([]byte("\x00")) // DimValue 0% to 100%
-			} else {
-				b.Write([]byte("\x04")) // DimValue 4% if RTS to emulate My function
-			}
-		case "x2dhaelec":
-			switch string(msg.Payload()) {
-			case "Eco", "EcoLow": // => %0
-				b.Write([]byte("\x00")) // Action 0 : OFF / 1 : ON
-			case "Confort", "ConfortLow": // => %3
-				b.Write([]byte("\x03")) // Action 0 : OFF / 1 : ON
-			case "Stop": // => %4
-				b.Write([]byte("\x04")) // Action 0 : OFF / 1 : ON
-			case "HorsGel": // => %5
-				b.Write([]byte("\x05")) // Action 0 : OFF / 1 : ON
-			case "Auto", "AutoLow": // => %7
-				b.Write([]byte("\x07")) // Action 0 : OFF / 1 : ON
-			}
-		}
+		switch actuatorProtocol(name) {
+		case "visonic433":
+			b.Write([]byte("\x00")) // DimValue 0% to 100%
+		case "chacon":
+			if dim < 0 {
+				b.Write([]byte("\x00")) // DimValue 0% to 100%
+			} else {
+				b.WriteByte(byte(dim)) // DimValue 0% to 100%
+			}
+		case "somfyrts":
+			if payload != "2" {
+				b.Write([]byte("\x00")) // DimValue 0% to 100%
+			} else {
+				b.Write([]byte("\x04")) // DimValue 4% if RTS to emulate My function
+			}
+		case "x2dhaelec":
+			switch payload {
+			case "Eco", "EcoLow": // => %0
+				b.Write([]byte("\x00")) // Action 0 : OFF / 1 : ON
+			case "Confort", "ConfortLow": // => %3
+				b.Write([]byte("\x03")) // Action 0 : OFF / 1 : ON
+			case "Stop": // => %4
+				b.Write([]byte("\x04")) // Action 0 : OFF / 1 : ON
+			case "HorsGel": // => %5
+				b.Write([]byte("\x05")) // Action 0 : OFF / 1 : ON
+			case "Auto", "AutoLow": // => %7
+				b.Write([]byte("\x07")) // Action 0 : OFF / 1 : ON
+			}
+		}
+
+		b.Write([]byte("\x00")) // Burst 0 by default
+		b.Write([]byte("\x00")) // Qualifier 0 by default
+		b.Write([]byte("\x00")) // Reserved2 0 by default
+
+		if log.GetLevel() == log.DebugLevel {
+			dumpByteSlice(b.Bytes())
+		}
+
+		/**
+		 * Wait for the state of the actuators reporting back
+		 */
+		if ref := actuatorRef(name); ref != "NULL" {
+			timeout := time.Duration(conf.GetInt("rfplayer.confirmtimeout")) * time.Millisecond
+			pendingConfirmsCache.Set(ref, name, timeout)
+		}
+
+		/**
+		 * Send the bytes array to the channel
+		 */
+		queueCommand(command{Name: name, Frame: b.Bytes()})
+	}
+}
+
+/**
+ * Function that handle MQTT message on <topicroot>/admin/pause
+ *
+ * - on : decoded readings are not published and commands are ignored
+ * - off : normal behavior
+ */
+var fPauseHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
+	switch string(msg.Payload()) {
+	case "on":
+		atomic.StoreInt32(&paused, 1)
+	case "off":
+		atomic.StoreInt32(&paused, 0)
+	default:
+		log.Warn("[ADMIN] Unknown pause payload : ", string(msg.Payload()))
+		return
+	}
+
+	log.Info("[ADMIN] Pause ", string(msg.Payload()))
+	go publishPauseState()
+}
+
+/**
+ * Function that publish the pause state, retained, on <topicroot>/admin/pause/state
+ */
+func publishPauseState() {
+	state := "off"
+	if atomic.LoadInt32(&paused) == 1 {
+		state = "on"
+	}
+
+	publishMessage(brokerTopicRoot()+"/admin/pause/state", 2, true, state)
+}
+
+/**
+ * Function that handle MQTT message on <topicroot>/admin/loglevel, to change the log level without restarting
+ */
+var fLogLevelHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
+	logLevel, err := log.ParseLevel(string(msg.Payload()))
+	if err != nil {
+		log.Warn("[ADMIN] Unknown log level : ", string(msg.Payload()))
+		return
+	}
+
+	log.SetLevel(logLevel)
+	log.Info("[ADMIN] Log level ", logLevel)
+	go publishLogLevel()
+}
+
+/**
+ * Function that publish the current log level, retained, on <topicroot>/admin/loglevel/state
+ */
+func publishLogLevel() {
+	publishMessage(brokerTopicRoot()+"/admin/loglevel/state", 2, true, log.GetLevel().String())
+}
+
+/**
+ * Progress of the self-test of the actuators, published on <topicroot>/admin/testactuators/progress
+ */
+type actuatorTestStep struct {
+	Tc       string `json:"tc"`
+	Actuator string `json:"actuator"`
+	Payload  string `json:"payload"`
+	Index    int    `json:"index"`
+	Total    int    `json:"total"`
+}
+
+/**
+ * Payloads of the self-test of the actuators, on then off, for the protocols not taking 1 and 0
+ */
+var actuatorTestPayloads = map[string][2]string{
+	"x2dhaelec": {"Confort", "Eco"},
+}
+
+/**
+ * Function that handle MQTT message on <topicroot>/admin/testactuators, to check the wiring and pairing at commissioning
+ * Any payload : each actuator is switched on then off after rfplayer.testdelay, one after the other
+ * The end of the test is published on <topicroot>/admin/testactuators/result
+ */
+var fTestActuatorsHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
+	if !atomic.CompareAndSwapInt32(&testingActuators, 0, 1) {
+		log.Warn("[ADMIN] Test of the actuators already running")
+		publishResult(brokerTopicRoot()+"/admin/testactuators/result", fmt.Errorf("test already running"))
+		return
+	}
+
+	log.Info("[ADMIN] Test of the actuators")
+	go testActuators()
+}
+
+/**
+ * Function that send on then off to every actuator, through home/action/<name> as a user would
+ * The commands are spaced by rfplayer.waittosend on top of the delay written by emit, not to flood the RF medium
+ */
+func testActuators() {
+	defer atomic.StoreInt32(&testingActuators, 0)
+
+	configLock.RLock()
+	names := make([]string, 0, len(config.Actuators))
+	for i := 0; i < len(config.Actuators); i++ {
+		names = append(names, config.Actuators[i].Name)
+	}
+	configLock.RUnlock()
+
+	delay := time.Duration(conf.GetInt("rfplayer.testdelay")) * time.Millisecond
+	for i, name := range names {
+		payloads, found := actuatorTestPayloads[actuatorProtocol(name)]
+		if !found {
+			payloads = [2]string{"1", "0"}
+		}
+
+		for j, payload := range payloads {
+			step := actuatorTestStep{
+				Tc:       time.Now().Format(time.RFC3339),
+				Actuator: name,
+				Payload:  payload,
+				Index:    i + 1,
+				Total:    len(names),
+			}
+			if p, err := json.Marshal(step); err == nil {
+				publishMessage(brokerTopicRoot()+"/admin/testactuators/progress", 0, false, string(p))
+			}
+			log.Info("[ADMIN] Test of ", name, " (", i+1, "/", len(names), ") : ", payload)
+
+			publishMessage("home/action/"+name, 1, false, payload)
+
+			if j == 0 {
+				time.Sleep(delay)
+			}
+			time.Sleep(time.Duration(iWait2Send) * time.Millisecond)
+		}
+	}
+
+	log.Info("[ADMIN] Test of the actuators done")
+	publishResult(brokerTopicRoot()+"/admin/testactuators/result", nil)
+}
+
+/**
+ * Function that handle MQTT message on <topicroot>/admin/caches, to check the loading of the config file
+ * Any payload : the sensors and actuators caches are published in JSON on <topicroot>/admin/caches/state
+ */
+var fCachesHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
+	caches := map[string]map[string]interface{}{
+		"sensors_name":       cacheContents(sensorsNameCache),
+		"sensors_topic":      cacheContents(sensorsTopicCache),
+		"sensors_aliases":    cacheContents(sensorsAliasesCache),
+		"actuators_id":       cacheContents(actuatorsIDCache),
+		"actuators_protocol": cacheContents(actuatorsProtocolCache),
+		"actuators_command":  cacheContents(actuatorsCommandCache),
+	}
+
+	payload, err := json.Marshal(caches)
+	if err != nil {
+		log.Error("[ADMIN] Unable to dump the caches: ", err)
+		return
+	}
+
+	log.Info("[ADMIN] Dump of the caches")
+	go publish(brokerTopicRoot()+"/admin/caches/state", string(payload))
+}
+
+/**
+ * Function that return the content of a cache, key by key
+ */
+func cacheContents(c *cache.Cache) map[string]interface{} {
+	contents := map[string]interface{}{}
+	if c == nil {
+		return contents
+	}
+
+	for k, item := range c.Items() {
+		contents[k] = item.Object
+	}
+
+	return contents
+}
+
+/**
+ * Function that handle MQTT message on <topicroot>/admin/reload, to apply the changes of the config file
+ * The result is published on <topicroot>/admin/reload/result
+ */
+var fReloadHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
+	log.Info("[ADMIN] Reload of the config file")
+
+	err := reloadConfig()
+	if err != nil {
+		log.Error("[ADMIN] Reload failed : ", err)
+	}
+	publishResult(brokerTopicRoot()+"/admin/reload/result", err)
+}
+
+/**
+ * Function that read the config file again and rebuild the caches of the sensors and actuators
+ * The sensors are announced again to Home Assistant on their next reading
+ * The serial and MQTT settings need a restart
+ */
+func reloadConfig() error {
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	if err := conf.ReadInConfig(); err != nil {
+		return fmt.Errorf("reading config file: %s", err)
+	}
+
+	var newConfig Config
+	if err := conf.Unmarshal(&newConfig); err != nil {
+		return fmt.Errorf("unmarshalling config file: %s", err)
+	}
+	config = newConfig
+
+	loadSensors()
+	loadActuators()
+
+	if discoveryCache != nil {
+		discoveryCache.Flush()
+	}
+
+	return nil
+}
+
+/**
+ * Function that reload the config each time the config file is written, with watchconfig set
+ * An editor may write the file several times, each write reloads it. A file that cannot be read keeps the running config
+ */
+func watchConfig() {
+	conf.OnConfigChange(func(e fsnotify.Event) {
+		log.Info("Config file changed : ", e.Name)
+
+		err := reloadConfig()
+		if err != nil {
+			log.Error("Reload of the config file failed : ", err)
+		}
+	})
+	conf.WatchConfig()
+}
+
+/**
+ * Synthetic reading received on <topicroot>/test/publish
+ *
+ * - { "topic": "...", "payload": ... } : payload is published as is on topic
+ * - { "ref": "...", "fields": { ... } } : fields are published on the topic of the sensor ref
+ */
+type testReading struct {
+	Topic   string                 `json:"topic"`
+	Payload json.RawMessage        `json:"payload"`
+	Ref     string                 `json:"ref"`
+	Fields  map[string]interface{} `json:"fields"`
+}
+
+/**
+ * Function that handle MQTT message on the test topic, to publish fake readings
+ * Only subscribed if test.enabled is set
+ */
+var fTestPublishHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
+	var r testReading
+
+	log.Debug(time.Now(), " --- fTestPublishHandler TOPIC: ", msg.Topic(), " MSG: ", string(msg.Payload()))
+
+	err := json.Unmarshal(msg.Payload(), &r)
+	if err != nil {
+		log.Error("[TEST] Invalid test reading: ", err)
+		return
+	}
+
+	/**
+	 * Raw payload on an explicit topic
+	 */
+	if r.Topic != "" {
+		var payload string
+		if json.Unmarshal(r.Payload, &payload) != nil {
+			payload = string(r.Payload)
+		}
+		log.Info("[TEST] Publishing fake payload on ", r.Topic)
+		go publish(r.Topic, payload)
+		return
+	}
+
+	if r.Ref == "" {
+		log.Error("[TEST] Test reading without topic nor ref")
+		return
+	}
+
+	/**
+	 * Fields of a sensor, the topic is resolved as for a decoded frame
+	 */
+	topic := sensorTopic(r.Ref)
+	if topic == "NULL" {
+		topic = brokerTopicRoot() + "/" + r.Ref + "/test"
+	}
+
+	fields := r.Fields
+	if fields == nil {
+		fields = map[string]interface{}{}
+	}
+	fields["v"] = payloadVersion
+	fields[timeField()] = time.Now().Format(time.RFC3339)
+	fields["r"] = r.Ref
+	if t := sensorType(r.Ref); t != "NULL" {
+		fields["type"] = t
+	}
+	fields["n"] = topicName(topic)
+	if conf.GetBool("brockermqtt.asciitopics") {
+		topic = asciiTopic(topic)
+	}
+
+	payload, err := json.Marshal(fields)
+	if err != nil {
+		log.Error("[TEST] Unable to build payload for ", r.Ref, ": ", err)
+		return
+	}
+
+	log.Info("[TEST] Publishing fake reading of ", r.Ref, " on ", topic)
+	go publish(topic, string(payload))
+}
+
+/**
+ * Function that check the rate of the commands against rfplayer.maxcommandspersecond
+ */
+func commandAllowed() bool {
+	max := conf.GetInt("rfplayer.maxcommandspersecond")
+	if max <= 0 {
+		return true
+	}
+
+	commandLock.Lock()
+	defer commandLock.Unlock()
+
+	/**
+	 * Forget the commands older than one second
+	 */
+	now := time.Now()
+	i := 0
+	for i < len(commandTimes) && now.Sub(commandTimes[i]) >= time.Second {
+		i++
+	}
+	commandTimes = commandTimes[i:]
+
+	if len(commandTimes) >= max {
+		return false
+	}
+	commandTimes = append(commandTimes, now)
+
+	return true
+}
+
+/**
+ * Function that check that the dongle is ready to send commands
+ * - the serial port is open
+ * - rfplayer.ignorecommandsonstartup seconds have passed since the initialisation
+ */
+func commandsReady() error {
+	if atomic.LoadInt32(&serialUp) == 0 {
+		return fmt.Errorf("not ready: serial port closed")
+	}
 
-		b.Write([]byte("\x00")) // Burst 0 by default
-		b.Write([]byte("\x00")) // Qualifier 0 by default
-		b.Write([]byte("\x00")) // Reserved2 0 by default
+	window := time.Duration(conf.GetInt("rfplayer.ignorecommandsonstartup")) * time.Second
+	done := atomic.LoadInt64(&initDone)
+	if done == 0 || time.Since(time.Unix(0, done)) < window {
+		return fmt.Errorf("not ready: gateway starting")
+	}
 
-		if conf.GetString("log.level") == "debug" {
-			dumpByteSlice(b.Bytes())
-		}
+	return nil
+}
 
-		/**
-		 * Send the bytes array to the channel
-		 */
-		ch <- b.Bytes()
+/**
+ * Function that publish the result of a command on <topicroot>/action/<name>/result
+ */
+func publishAck(name string, err error) {
+	publishResult(brokerTopicRoot()+"/action/"+name+"/result", err)
+}
+
+/**
+ * Function that publish the result of a request, { "tc": ..., "success": ..., "error": ... }, on topic t
+ */
+func publishResult(t string, err error) {
+	ack := commandAck{
+		Tc:      time.Now().Format(time.RFC3339),
+		Success: err == nil,
+	}
+	if err != nil {
+		ack.Error = err.Error()
+	}
+
+	payload, errm := json.Marshal(ack)
+	if errm != nil {
+		log.Error("Unable to build result for ", t, ": ", errm)
+		return
 	}
+
+	go publish(t, string(payload))
 }
 
 /**
@@ -1299,6 +3801,16 @@ func loadSensors() {
 	 */
 	sensorsNameCache = cache.New(cache.NoExpiration, cache.NoExpiration)
 	sensorsTopicCache = cache.New(cache.NoExpiration, cache.NoExpiration)
+	sensorsFieldsCache = cache.New(cache.NoExpiration, cache.NoExpiration)
+	sensorsAliasesCache = cache.New(cache.NoExpiration, cache.NoExpiration)
+	sensorsTransformCache = cache.New(cache.NoExpiration, cache.NoExpiration)
+	sensorsProtocolCache = cache.New(cache.NoExpiration, cache.NoExpiration)
+	sensorsMaxStaleCache = cache.New(cache.NoExpiration, cache.NoExpiration)
+	sensorsTypeCache = cache.New(cache.NoExpiration, cache.NoExpiration)
+	sensorsDeviceClassCache = cache.New(cache.NoExpiration, cache.NoExpiration)
+	sensorsExpectedCache = cache.New(cache.NoExpiration, cache.NoExpiration)
+	sensorsPublishCache = cache.New(cache.NoExpiration, cache.NoExpiration)
+	metricRFLevel.Reset() // No series left for the sensors removed from the config
 
 	/**
 	 * Load the cache
@@ -1326,6 +3838,14 @@ func loadSensors() {
 			if err != nil {
 				log.Info("ERROR while adding sensor in topic cache, already defined ", id, " !!!")
 			}
+		} else if config.Sensors[i].Type != "" {
+			/**
+			 * Si un type est défini, topic <topicroot>/<type>/<name>/state
+			 */
+			err := sensorsTopicCache.Add(id, brokerTopicRoot()+"/"+config.Sensors[i].Type+"/"+name+"/state", cache.NoExpiration)
+			if err != nil {
+				log.Info("ERROR while adding sensor in topic cache, already defined ", id, " !!!")
+			}
 		} else {
 			/**
 			 * Si pas de topic défini, on prend le paramètre name
@@ -1337,6 +3857,124 @@ func loadSensors() {
 
 		}
 
+		/**
+		 * Protocol cache, only if the protocol label is overridden
+		 */
+		if config.Sensors[i].Protocol != "" {
+			err := sensorsProtocolCache.Add(id, config.Sensors[i].Protocol, cache.NoExpiration)
+			if err != nil {
+				log.Info("ERROR while adding sensor in protocol cache, already defined ", id, " !!!")
+			}
+		}
+
+		/**
+		 * Publish options cache, indexed by the topic of the sensor, only if overridden
+		 */
+		if config.Sensors[i].QoS != nil || config.Sensors[i].Retain != nil || config.Sensors[i].Class != "" {
+			options := publishOptions{byte(conf.GetInt("brockermqtt.qos")), conf.GetBool("brockermqtt.retain")}
+			if class, found := sensorClasses[config.Sensors[i].Class]; found {
+				options = class
+			} else if config.Sensors[i].Class != "" {
+				log.Warn("Unknown class ", config.Sensors[i].Class, " for sensor ", id, ", brockermqtt.qos and brockermqtt.retain used")
+			}
+			if config.Sensors[i].QoS != nil {
+				options.QoS = byte(*config.Sensors[i].QoS)
+			}
+			if config.Sensors[i].Retain != nil {
+				options.Retain = *config.Sensors[i].Retain
+			}
+			publishTopic := sensorTopic(id)
+			if conf.GetBool("brockermqtt.asciitopics") {
+				publishTopic = asciiTopic(publishTopic) // Topic the readings are published on, looked up by publishReading
+			}
+			sensorsPublishCache.Set(publishTopic, options, cache.NoExpiration)
+			for _, alias := range config.Sensors[i].Topics {
+				if conf.GetBool("brockermqtt.asciitopics") {
+					alias = asciiTopic(alias)
+				}
+				sensorsPublishCache.Set(alias, options, cache.NoExpiration)
+			}
+		}
+
+		/**
+		 * Expected protocol cache, only if defined
+		 */
+		if config.Sensors[i].ExpectedProtocol != "" {
+			err := sensorsExpectedCache.Add(id, config.Sensors[i].ExpectedProtocol, cache.NoExpiration)
+			if err != nil {
+				log.Info("ERROR while adding sensor in expected protocol cache, already defined ", id, " !!!")
+			}
+		}
+
+		/**
+		 * Type cache, only if defined
+		 */
+		if config.Sensors[i].Type != "" {
+			err := sensorsTypeCache.Add(id, config.Sensors[i].Type, cache.NoExpiration)
+			if err != nil {
+				log.Info("ERROR while adding sensor in type cache, already defined ", id, " !!!")
+			}
+		}
+
+		/**
+		 * Home Assistant device class cache, only if defined
+		 */
+		if config.Sensors[i].DeviceClass != "" {
+			err := sensorsDeviceClassCache.Add(id, config.Sensors[i].DeviceClass, cache.NoExpiration)
+			if err != nil {
+				log.Info("ERROR while adding sensor in device class cache, already defined ", id, " !!!")
+			}
+		}
+
+		/**
+		 * Maximum staleness cache, only if overridden
+		 */
+		if config.Sensors[i].MaxStale > 0 {
+			err := sensorsMaxStaleCache.Add(id, time.Duration(config.Sensors[i].MaxStale)*time.Second, cache.NoExpiration)
+			if err != nil {
+				log.Info("ERROR while adding sensor in max stale cache, already defined ", id, " !!!")
+			}
+		}
+
+		/**
+		 * Aliases cache, only if defined
+		 */
+		if len(config.Sensors[i].Topics) > 0 {
+			err := sensorsAliasesCache.Add(id, config.Sensors[i].Topics, cache.NoExpiration)
+			if err != nil {
+				log.Info("ERROR while adding sensor in aliases cache, already defined ", id, " !!!")
+			}
+		}
+
+		/**
+		 * Fields cache, only if an allowlist is defined
+		 */
+		if len(config.Sensors[i].Fields) > 0 {
+			err := sensorsFieldsCache.Add(id, config.Sensors[i].Fields, cache.NoExpiration)
+			if err != nil {
+				log.Info("ERROR while adding sensor in fields cache, already defined ", id, " !!!")
+			}
+		}
+
+		/**
+		 * Transforms cache, expressions are compiled once
+		 */
+		if len(config.Sensors[i].Transform) > 0 {
+			transforms := map[string]*govaluate.EvaluableExpression{}
+			for field, expression := range config.Sensors[i].Transform {
+				e, err := govaluate.NewEvaluableExpression(expression)
+				if err != nil {
+					log.Error("Invalid transform of field ", field, " for sensor ", id, " : ", err)
+					continue
+				}
+				transforms[field] = e
+			}
+			err := sensorsTransformCache.Add(id, transforms, cache.NoExpiration)
+			if err != nil {
+				log.Info("ERROR while adding sensor in transform cache, already defined ", id, " !!!")
+			}
+		}
+
 		log.Info("[loadSensors] Number of sensors defined : ", sensorsNameCache.ItemCount())
 	}
 }
@@ -1358,6 +3996,8 @@ func loadActuators() {
 	actuatorsTopicCache = cache.New(cache.NoExpiration, cache.NoExpiration)
 	actuatorsCommandCache = cache.New(cache.NoExpiration, cache.NoExpiration)
 	actuatorsProtocolCache = cache.New(cache.NoExpiration, cache.NoExpiration)
+	actuatorsRefCache = cache.New(cache.NoExpiration, cache.NoExpiration)
+	actuatorsSourceDestCache = cache.New(cache.NoExpiration, cache.NoExpiration)
 
 	/**
 	 * Load the cache
@@ -1398,12 +4038,35 @@ func loadActuators() {
 		/**
 		 * Protocol cache
 		 */
-		value = config.Actuators[i].Protocol
+		value = canonicalProtocol(config.Actuators[i].Protocol)
 		log.Info("Loading actuator command protocol ", i, " Name:", name, " Protocol:", value)
 		err = actuatorsProtocolCache.Add(name, value, cache.NoExpiration)
 		if err != nil {
 			log.Info("ERROR while adding actuator protocol, already defined ", name, " !!!")
 		}
+
+		/**
+		 * Source-dest cache, only if not the default one
+		 */
+		if config.Actuators[i].SourceDest != 0 {
+			log.Info("Loading actuator source-dest ", i, " Name:", name, " SourceDest:", config.Actuators[i].SourceDest)
+			err = actuatorsSourceDestCache.Add(name, config.Actuators[i].SourceDest, cache.NoExpiration)
+			if err != nil {
+				log.Info("ERROR while adding actuator source-dest, already defined ", name, " !!!")
+			}
+		}
+
+		/**
+		 * Ref cache, only for the actuators reporting back their state
+		 */
+		if config.Actuators[i].ReportsBack && config.Actuators[i].Ref != "" {
+			value = config.Actuators[i].Ref
+			log.Info("Loading actuator ref ", i, " Name:", name, " Ref:", value)
+			err = actuatorsRefCache.Add(name, value, cache.NoExpiration)
+			if err != nil {
+				log.Info("ERROR while adding actuator ref, already defined ", name, " !!!")
+			}
+		}
 	}
 
 	log.Info("[loadActuators] Numbre of actuator defined : ", actuatorsIDCache.ItemCount())
@@ -1426,37 +4089,244 @@ func sensorName(sensorID string) string {
 }
 
 /**
- * Function that return the sensor topic by its ID if it exists
+ * Function that return the sensor topic by its ID if it exists
+ */
+func sensorTopic(sensorID string) string {
+	var r string
+
+	foo, found := sensorsTopicCache.Get(sensorID)
+	if found {
+		r = foo.(string)
+	} else {
+		r = "NULL"
+		log.Info("Fail to find sensorId : >", sensorID, "<")
+	}
+
+	return r
+}
+
+/**
+ * Function that return the protocol label of a sensor by its ID if it is overridden in config
+ */
+func sensorProtocol(sensorID string) string {
+	var r string
+
+	foo, found := sensorsProtocolCache.Get(sensorID)
+	if found {
+		r = foo.(string)
+	} else {
+		r = "NULL"
+	}
+
+	return r
+}
+
+/**
+ * QoS and retain flag of the readings
+ */
+type publishOptions struct {
+	QoS    byte
+	Retain bool
+}
+
+/**
+ * QoS and retain flag of the sensor classes, a shorthand for the reliability of the readings
+ */
+var sensorClasses = map[string]publishOptions{
+	"critical":  {2, true},  // Security sensors, never lost
+	"telemetry": {0, false}, // Weather and energy readings, a lost one is replaced by the next
+}
+
+/**
+ * Function that return the QoS and retain flag of the readings published on a topic
+ * brockermqtt.qos and brockermqtt.retain unless overridden by the class, qos or retain of the sensor
+ */
+func readingOptions(t string) publishOptions {
+	foo, found := sensorsPublishCache.Get(t)
+	if found {
+		return foo.(publishOptions)
+	}
+
+	return publishOptions{byte(conf.GetInt("brockermqtt.qos")), conf.GetBool("brockermqtt.retain")}
+}
+
+/**
+ * Function that return the protocol expected for a sensor by its ID if it exists
+ */
+func sensorExpectedProtocol(sensorID string) string {
+	var r string
+
+	foo, found := sensorsExpectedCache.Get(sensorID)
+	if found {
+		r = foo.(string)
+	} else {
+		r = "NULL"
+	}
+
+	return r
+}
+
+/**
+ * Function that return the Home Assistant device class of a sensor by its ID if it exists
+ */
+func sensorDeviceClass(sensorID string) string {
+	var r string
+
+	foo, found := sensorsDeviceClassCache.Get(sensorID)
+	if found {
+		r = foo.(string)
+	} else {
+		r = "NULL"
+	}
+
+	return r
+}
+
+/**
+ * Function that return the type of a sensor by its ID if it exists
+ */
+func sensorType(sensorID string) string {
+	var r string
+
+	foo, found := sensorsTypeCache.Get(sensorID)
+	if found {
+		r = foo.(string)
+	} else {
+		r = "NULL"
+	}
+
+	return r
+}
+
+/**
+ * Function that return the maximum staleness of a sensor by its ID, brockermqtt.maxstale if not overridden
+ */
+func sensorMaxStale(sensorID string) time.Duration {
+	foo, found := sensorsMaxStaleCache.Get(sensorID)
+	if found {
+		return foo.(time.Duration)
+	}
+
+	return time.Duration(conf.GetInt("brockermqtt.maxstale")) * time.Second
+}
+
+/**
+ * Function that return the topics a sensor is also published on by its ID, nil if none
+ */
+func sensorAliases(sensorID string) []string {
+	foo, found := sensorsAliasesCache.Get(sensorID)
+	if found {
+		return foo.([]string)
+	}
+
+	return nil
+}
+
+/**
+ * Function that return the topics a reading of a sensor is published on, its topic then its aliases
+ * The aliases are for the consumers not yet moved to the new topic, they are left out with another sink than mqtt
+ * and with brockermqtt.batchwindow, unless brockermqtt.batchkeeptopics, not to batch the same reading twice
+ */
+func readingTopics(t string, sensorID string) []string {
+	topics := []string{t}
+	if conf.GetString("sink.type") != "mqtt" {
+		return topics
+	}
+	if conf.GetInt("brockermqtt.batchwindow") > 0 && !conf.GetBool("brockermqtt.batchkeeptopics") {
+		return topics
+	}
+
+	for _, alias := range sensorAliases(sensorID) {
+		if conf.GetBool("brockermqtt.asciitopics") {
+			alias = asciiTopic(alias)
+		}
+		topics = append(topics, alias)
+	}
+
+	return topics
+}
+
+/**
+ * Function that return the fields to publish for a sensor by its ID, nil if all fields are published
+ */
+func sensorFields(sensorID string) []string {
+	foo, found := sensorsFieldsCache.Get(sensorID)
+	if found {
+		return foo.([]string)
+	}
+
+	return nil
+}
+
+/**
+ * Function that return the compiled transforms of a sensor by its ID, indexed by field
+ */
+func sensorTransforms(sensorID string) map[string]*govaluate.EvaluableExpression {
+	foo, found := sensorsTransformCache.Get(sensorID)
+	if found {
+		return foo.(map[string]*govaluate.EvaluableExpression)
+	}
+
+	return nil
+}
+
+/**
+ * Function the return a X10 code of the actuator by its name
+ */
+func actuatorID(actuatorName string) string {
+	var r string
+
+	foo, found := actuatorsIDCache.Get(actuatorName)
+	if found {
+		r = foo.(string)
+	} else {
+		r = "NULL"
+	}
+
+	log.Debug(time.Now(), " ### actuatorID of ", actuatorName, " is >", r, "<")
+
+	return r
+}
+
+/**
+ * Function that return the canonical name of a protocol, resolving its alias if any
  */
-func sensorTopic(sensorID string) string {
-	var r string
+func canonicalProtocol(protocol string) string {
+	if canonical, found := config.Protocols.Aliases[protocol]; found {
+		return canonical
+	}
+	if canonical, found := defaultProtocolAliases[protocol]; found {
+		return canonical
+	}
 
-	foo, found := sensorsTopicCache.Get(sensorID)
+	return protocol
+}
+
+/**
+ * Function that return the source-dest qualifier of the frames sent to the actuator by its name
+ */
+func actuatorSourceDest(actuatorName string) byte {
+	foo, found := actuatorsSourceDestCache.Get(actuatorName)
 	if found {
-		r = foo.(string)
-	} else {
-		r = "NULL"
-		log.Info("Fail to find sensorId : >", sensorID, "<")
+		return foo.(byte)
 	}
 
-	return r
+	return sourceDest433868
 }
 
 /**
- * Function the return a X10 code of the actuator by its name
+ * Function that return the ref of the frames sent back by the actuator by its name
  */
-func actuatorID(actuatorName string) string {
+func actuatorRef(actuatorName string) string {
 	var r string
 
-	foo, found := actuatorsIDCache.Get(actuatorName)
+	foo, found := actuatorsRefCache.Get(actuatorName)
 	if found {
 		r = foo.(string)
 	} else {
 		r = "NULL"
 	}
 
-	log.Debug(time.Now(), " ### actuatorID of ", actuatorName, " is >", r, "<")
-
 	return r
 }
 
@@ -1482,13 +4352,97 @@ func actuatorProtocol(actuatorName string) string {
  */
 func connUpHandler(c mqtt.Client) {
 	log.Info("[MQTT] Connection up...")
+	if atomic.AddUint64(&mqttConnections, 1) > 1 {
+		metricReconnects.WithLabelValues("mqtt").Inc()
+	}
 
 	// Subscribe now we are connected
-	if tokenS := cmqtt.Subscribe("home/action/#", 2, fMqttMsgHandler); tokenS.Wait() && tokenS.Error() != nil {
+	if tokenS := cmqtt.Subscribe(gatewayTopic("home/action/#"), 2, fMqttMsgHandler); tokenS.Wait() && tokenS.Error() != nil {
 		log.Info("[MQTT] Subscription failed...")
 		//panic(tokenS.Error())
 	} else {
-		log.Info("[MQTT] Subscribed to home/action/# topic ...")
+		log.Info("[MQTT] Subscribed to ", gatewayTopic("home/action/#"), " topic ...")
+	}
+
+	// Announce the gateway, the broker publishes the last will if it is lost
+	publishMessage(statusTopic(), 1, true, conf.GetString("brockermqtt.statusonline"))
+	publishActuatorsAvailability()
+
+	// Subscribe to the test topic if enabled
+	if conf.GetBool("test.enabled") {
+		mqttSubscribe(brokerTopicRoot()+"/test/publish", fTestPublishHandler)
+	}
+
+	// Subscribe to the admin topics and publish their current state
+	mqttSubscribe(brokerTopicRoot()+"/admin/pause", fPauseHandler)
+	publishPauseState()
+	mqttSubscribe(brokerTopicRoot()+"/admin/loglevel", fLogLevelHandler)
+	mqttSubscribe(brokerTopicRoot()+"/admin/reload", fReloadHandler)
+	mqttSubscribe(brokerTopicRoot()+"/admin/caches", fCachesHandler)
+	mqttSubscribe(brokerTopicRoot()+"/admin/testactuators", fTestActuatorsHandler)
+	if simFrames != nil {
+		mqttSubscribe(brokerTopicRoot()+"/sim/frames", fSimFrameHandler)
+	}
+	publishLogLevel()
+
+	atomic.StoreInt32(&mqttSubscribed, 1)
+
+	// Announce again the sensors already seen to Home Assistant
+	if conf.GetBool("homeassistant.discovery") {
+		go republishDiscovery()
+	}
+
+	// Describe the readings for the consumers
+	if conf.GetBool("brockermqtt.publishschema") {
+		go publishSchema()
+	}
+
+	// Restore the last readings if the broker lost them
+	if conf.GetBool("brockermqtt.resyncretained") {
+		go resyncReadings()
+	}
+}
+
+/**
+ * Function that publish, retained, the availability of each actuator on <topicroot>/action/<name>/availability
+ * RF actuators are write only : it is the ability of the gateway to transmit, online while the serial port is
+ * open and the gateway not stopping, not the state of the device. Only with brockermqtt.actuatoravailability
+ */
+func publishActuatorsAvailability() {
+	if !conf.GetBool("brockermqtt.actuatoravailability") {
+		return
+	}
+
+	state := conf.GetString("brockermqtt.statusonline")
+	if atomic.LoadInt32(&serialUp) == 0 || atomic.LoadInt32(&stopping) == 1 {
+		state = conf.GetString("brockermqtt.statusoffline")
+	}
+
+	for i := 0; i < len(config.Actuators); i++ {
+		publishMessage(brokerTopicRoot()+"/action/"+config.Actuators[i].Name+"/availability", 1, true, state)
+	}
+}
+
+/**
+ * Function that return the status topic of the gateway, <topicroot>/status by default
+ */
+func statusTopic() string {
+	if topic := conf.GetString("brockermqtt.statustopic"); topic != "" {
+		return topic
+	}
+
+	return brokerTopicRoot() + "/status"
+}
+
+/**
+ * Function that subscribe to a topic with its handler
+ */
+func mqttSubscribe(topic string, handler mqtt.MessageHandler) {
+	topic = gatewayTopic(topic)
+	if tokenS := cmqtt.Subscribe(topic, 2, handler); tokenS.Wait() && tokenS.Error() != nil {
+		log.Info("[MQTT] Subscription to ", topic, " failed...")
+	} else {
+		log.Info("[MQTT] Subscribed to ", topic, " topic ...")
 	}
 }
 
@@ -1498,6 +4452,7 @@ func connUpHandler(c mqtt.Client) {
  */
 func connLostHandler(c mqtt.Client, err error) {
 	log.Info("[MQTT] Connection lost, reason: ", err)
+	atomic.StoreInt32(&mqttSubscribed, 0)
 
 	//Perform additional action...
 }
@@ -1555,16 +4510,38 @@ func mqttSetupAndConnect() {
 		cmqttOpts.SetTLSConfig(tlsConfig) //we set the tls configuration
 	}
 
-	cmqttOpts.AddBroker(broker.String())                          // Add broker information
-	cmqttOpts.SetClientID("rfp2mqtt_pubsub")                      // Add client_id
-	cmqttOpts.SetUsername(conf.GetString("brockermqtt.username")) // Add username
-	cmqttOpts.SetPassword(conf.GetString("brockermqtt.password")) // And password
-	cmqttOpts.SetConnectionLostHandler(connLostHandler)           // Add also en handler for handling lost connection
-	cmqttOpts.SetOnConnectHandler(connUpHandler)                  // Add hendler when connection is performed
+	// Two gateways sharing a broker need their own client id, or each connection kicks the other
+	clientID := "rfp2mqtt_pubsub"
+	if prefix := conf.GetString("brockermqtt.gatewayprefix"); prefix != "" {
+		clientID += "_" + prefix
+	}
+
+	cmqttOpts.AddBroker(broker.String())                                                                 // Add broker information
+	cmqttOpts.SetClientID(clientID)                                                                      // Add client_id
+	cmqttOpts.SetUsername(conf.GetString("brockermqtt.username"))                                        // Add username
+	cmqttOpts.SetPassword(conf.GetString("brockermqtt.password"))                                        // And password
+	cmqttOpts.SetConnectionLostHandler(connLostHandler)                                                  // Add also en handler for handling lost connection
+	cmqttOpts.SetOnConnectHandler(connUpHandler)                                                         // Add hendler when connection is performed
+	cmqttOpts.SetWill(gatewayTopic(statusTopic()), conf.GetString("brockermqtt.statusoffline"), 1, true) // Published by the broker if the gateway is lost
 	cmqttOpts.AutoReconnect = false
 
+	/**
+	 * With brockermqtt.autoreconnect, Paho retries the first connection and reconnects by itself,
+	 * connUpHandler subscribing again on each connection of the same client
+	 */
+	autoReconnect := conf.GetBool("brockermqtt.autoreconnect")
+	if autoReconnect {
+		cmqttOpts.SetAutoReconnect(true)
+		cmqttOpts.SetMaxReconnectInterval(time.Duration(conf.GetInt("brockermqtt.reconnectmaxinterval")) * time.Second)
+		cmqttOpts.SetConnectRetry(true)
+		cmqttOpts.SetConnectRetryInterval(time.Duration(conf.GetInt("brockermqtt.reconnectinterval")) * time.Second)
+	}
+
 	cmqtt = mqtt.NewClient(cmqttOpts)
-	if tokenC := cmqtt.Connect(); tokenC.Wait() && tokenC.Error() != nil {
+	if autoReconnect {
+		cmqtt.Connect() // Completed once connected, connUpHandler reports it
+		log.Info("[MQTT] Connecting to broker, retried until connected...")
+	} else if tokenC := cmqtt.Connect(); tokenC.Wait() && tokenC.Error() != nil {
 		log.Info("[MQTT] Connection failed...")
 		// panic(tokenC.Error())
 	} else {
@@ -1572,6 +4549,245 @@ func mqttSetupAndConnect() {
 	}
 }
 
+/**
+ * Compute the next waiting time of a backoff, bounded by max
+ */
+func nextBackoff(wait time.Duration, factor float64, max time.Duration) time.Duration {
+	next := time.Duration(float64(wait) * factor)
+	if next > max {
+		next = max
+	}
+
+	return next
+}
+
+/**
+ * Function that check the MQTT connection and reconnect when lost
+ *
+ * - First try after brockermqtt.reconnectinterval seconds
+ * - Then the waiting time is multiplied by brockermqtt.reconnectbackoff up to brockermqtt.reconnectmaxinterval
+ */
+func mqttReconnect() {
+	interval := time.Duration(conf.GetInt("brockermqtt.reconnectinterval")) * time.Second
+	maxInterval := time.Duration(conf.GetInt("brockermqtt.reconnectmaxinterval")) * time.Second
+	factor := conf.GetFloat64("brockermqtt.reconnectbackoff")
+
+	wait := interval
+	for {
+		time.Sleep(wait)
+		if cmqtt.IsConnectionOpen() {
+			wait = interval
+			continue
+		}
+
+		log.Info("[MQTT] Not connected, trying to reconnect in ", wait, "...")
+		mqttSetupAndConnect()
+		if cmqtt.IsConnectionOpen() {
+			wait = interval
+		} else {
+			wait = nextBackoff(wait, factor, maxInterval)
+		}
+	}
+}
+
+/**
+ * Function that report an error on the serial port to serialReopen
+ * Reading and writing can both fail on an unplugged dongle, the port is reopened once
+ */
+func reportSerialLost(err error) {
+	select {
+	case serialLost <- err:
+	default:
+		log.Debug("[RFP] Serial port already reported lost: ", err)
+	}
+}
+
+/**
+ * Function that log an error opening the serial port, with the usual fix of a permission denied at first run
+ */
+func logSerialOpenError(err error) {
+	if os.IsPermission(err) {
+		log.Error("[RFP] Permission denied on serial port ", rfpConfig.PortName, " : add the user running rfp2mqtt to the dialout group (usermod -a -G dialout <user>, then log in again) or give access to the port with a udev rule (MODE=\"0660\", GROUP=\"dialout\")")
+		return
+	}
+
+	log.Error("[RFP] Error opening serial port ", rfpConfig.PortName, " : ", err)
+}
+
+/**
+ * Function that open the serial port of the RFPlayer dongle at startup
+ *
+ * The permissions are often fixed after the service is started: on a permission denied, keep trying
+ * with the waiting times of rfplayer.reopeninterval, rfplayer.reopenbackoff and rfplayer.reopenmaxinterval
+ */
+func openSerialPort() (io.ReadWriteCloser, error) {
+	p, err := rfpOpen(rfpConfig)
+
+	wait := time.Duration(conf.GetInt("rfplayer.reopeninterval")) * time.Second
+	for err != nil && os.IsPermission(err) {
+		logSerialOpenError(err)
+		log.Info("[RFP] New try in ", wait)
+		time.Sleep(wait)
+		p, err = rfpOpen(rfpConfig)
+		wait = nextBackoff(wait, conf.GetFloat64("rfplayer.reopenbackoff"), time.Duration(conf.GetInt("rfplayer.reopenmaxinterval"))*time.Second)
+	}
+
+	return p, err
+}
+
+/**
+ * Function that reopen the serial port of the RFPlayer dongle when an error is reported
+ *
+ * - First try after rfplayer.reopeninterval seconds
+ * - Then the waiting time is multiplied by rfplayer.reopenbackoff up to rfplayer.reopenmaxinterval
+ * - Once reopened, the initialisation commands are sent again, the dongle may have been reset
+ */
+func serialReopen() {
+	interval := time.Duration(conf.GetInt("rfplayer.reopeninterval")) * time.Second
+	maxInterval := time.Duration(conf.GetInt("rfplayer.reopenmaxinterval")) * time.Second
+	factor := conf.GetFloat64("rfplayer.reopenbackoff")
+
+	for {
+		err := <-serialLost
+		log.Error("[RFP] Serial port lost: ", err)
+		atomic.StoreInt32(&serialUp, 0)
+		serialPort().Close()
+		publishActuatorsAvailability()
+
+		var p io.ReadWriteCloser
+		wait := interval
+		for {
+			time.Sleep(wait)
+			p, err = rfpOpen(rfpConfig)
+			if err == nil {
+				setSerialPort(p)
+				atomic.StoreInt32(&serialUp, 1)
+				break
+			}
+			logSerialOpenError(err)
+			wait = nextBackoff(wait, factor, maxInterval)
+		}
+		log.Info("[RFP] Serial port ", rfpConfig.PortName, " reopened")
+		metricReconnects.WithLabelValues("serial").Inc()
+
+		/**
+		 * Forget the errors of the closed port, reported while reopening
+		 */
+		select {
+		case <-serialLost:
+		default:
+		}
+
+		if conf.GetBool("rfplayer.rx") {
+			go receive(p)
+		}
+
+		sendInitialisation(p)
+		atomic.StoreInt64(&initDone, time.Now().UnixNano())
+		log.Info("[RFP] RFPlayer reconnected, initialisation commands sent again")
+		publishActuatorsAvailability()
+	}
+}
+
+/**
+ * Function that return the watchdog topic, <topicroot>/watchdog by default
+ */
+func watchdogTopic() string {
+	if topic := conf.GetString("brockermqtt.watchdogtopic"); topic != "" {
+		return topic
+	}
+
+	return brokerTopicRoot() + "/watchdog"
+}
+
+/**
+ * Function that return the health of the gateway, for the HTTP healthcheck
+ * - serial_ok : serial port open
+ * - mqtt_ok : connected to the broker, always true with the stdout sink
+ * - ready : initialisation of the dongle done and topics subscribed
+ */
+func health() healthStatus {
+	stdout := conf.GetString("sink.type") == "stdout"
+
+	return healthStatus{
+		SerialOK: atomic.LoadInt32(&serialUp) == 1,
+		MqttOK:   stdout || (cmqtt != nil && cmqtt.IsConnectionOpen()),
+		Ready:    atomic.LoadInt64(&initDone) != 0 && (stdout || atomic.LoadInt32(&mqttSubscribed) == 1),
+	}
+}
+
+/**
+ * Function that serve the HTTP healthcheck on http.listen
+ * - /healthz : 200 if the serial port is open and MQTT connected, 503 otherwise
+ * - /readyz : 200 once the initialisation is done and the topics subscribed, 503 before
+ * - /metrics : Prometheus metrics, with http.metrics
+ */
+func healthServer() {
+	reply := func(w http.ResponseWriter, ok bool) {
+		payload, _ := json.Marshal(health())
+		w.Header().Set("Content-Type", "application/json")
+		if !ok {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		w.Write(payload)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		h := health()
+		reply(w, h.SerialOK && h.MqttOK)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, health().Ready)
+	})
+
+	if conf.GetBool("http.metrics") {
+		prometheus.MustRegister(metricFramesReceived, metricFramesDecoded, metricFramesRejected, metricMqttPublished,
+			metricCommandsReceived, metricReconnects, metricRFLevel)
+		mux.Handle("/metrics", promhttp.Handler())
+	}
+
+	log.Info("[HTTP] Healthcheck listening on ", conf.GetString("http.listen"))
+	if err := http.ListenAndServe(conf.GetString("http.listen"), mux); err != nil {
+		log.Error("[HTTP] Healthcheck stopped: ", err)
+	}
+}
+
+/**
+ * Function that build the watchdog message with the health of the serial link
+ *
+ * - serial_ok : serial port open and bytes read during the last rfplayer.maxsilence seconds (if reception is active)
+ * - last_frame_age_seconds : age of the last frame received
+ * - uptime_seconds and frames_received : since the start of the gateway
+ */
+func watchdogMessage() string {
+	now := time.Now()
+
+	hb := heartbeat{
+		Tc:                  now.Format(time.RFC3339),
+		SerialOK:            atomic.LoadInt32(&serialUp) == 1,
+		LastFrameAgeSeconds: -1,
+		UptimeSeconds:       int64(now.Sub(startTime).Seconds()),
+		FramesReceived:      atomic.LoadUint64(&framesReceived),
+	}
+
+	if conf.GetBool("rfplayer.rx") && now.Unix()-atomic.LoadInt64(&lastBytesTime) > int64(conf.GetInt("rfplayer.maxsilence")) {
+		hb.SerialOK = false
+	}
+
+	if last := atomic.LoadInt64(&lastFrameTime); last != 0 {
+		hb.LastFrameAgeSeconds = now.Unix() - last
+	}
+
+	payload, err := json.Marshal(hb)
+	if err != nil {
+		log.Error("Unable to build watchdog message: ", err)
+		return hb.Tc
+	}
+
+	return string(payload)
+}
+
 /**
  * Function called when rfplayer start
  *
@@ -1583,37 +4799,118 @@ func init() {
 	 * Setup default conf
 	 */
 	// Configuration par défaut
-	conf.SetDefault("rfplayer.waittosend", "500")            // Time between to message send to rfp module
-	conf.SetDefault("rfplayer.port", "/dev/ttyUSB0")         // Port série
-	conf.SetDefault("rfplayer.baud", "115200")               // Baud rate
-	conf.SetDefault("rfplayer.data", "8")                    // Data bits
-	conf.SetDefault("rfplayer.parity", "none")               // Parity : none / odd / even
-	conf.SetDefault("rfplayer.stop", "1")                    // Stop bits
-	conf.SetDefault("rfplayer.rtsctsflowcontrol", "false")   // RTSCTS flow control
-	conf.SetDefault("rfplayer.rs485", "false")               // enable RS485 RTS for direction control
-	conf.SetDefault("rfplayer.rs485highduringsend", "false") // RTS signal should be high during send
-	conf.SetDefault("rfplayer.rs485highaftersend", "false")  // RTS signal should be high after send
-	conf.SetDefault("rfplayer.timeout", "100")               // Inter Character timeout (ms)
-	conf.SetDefault("rfplayer.minread", "10")                // Minimum read count
-	conf.SetDefault("rfplayer.rx", "true")                   // Activate Read data Received
-	conf.SetDefault("rfplayer.jamming", "10")                // Level of Jamming
-	conf.SetDefault("brokermqtt.protocol", "tls")
-	conf.SetDefault("brokermqtt.address", "127.0.0.1")
+	conf.SetDefault("rfplayer.waittosend", "500")             // Time between to message send to rfp module
+	conf.SetDefault("rfplayer.port", "/dev/ttyUSB0")          // Port série
+	conf.SetDefault("rfplayer.baud", "115200")                // Baud rate
+	conf.SetDefault("rfplayer.data", "8")                     // Data bits
+	conf.SetDefault("rfplayer.parity", "none")                // Parity : none / odd / even
+	conf.SetDefault("rfplayer.stop", "1")                     // Stop bits
+	conf.SetDefault("rfplayer.rtsctsflowcontrol", "false")    // RTSCTS flow control
+	conf.SetDefault("rfplayer.rs485", "false")                // enable RS485 RTS for direction control
+	conf.SetDefault("rfplayer.rs485highduringsend", "false")  // RTS signal should be high during send
+	conf.SetDefault("rfplayer.rs485highaftersend", "false")   // RTS signal should be high after send
+	conf.SetDefault("rfplayer.timeout", "100")                // Inter Character timeout (ms)
+	conf.SetDefault("rfplayer.minread", "10")                 // Minimum read count
+	conf.SetDefault("rfplayer.rx", "true")                    // Activate Read data Received
+	conf.SetDefault("rfplayer.jamming", "10")                 // Level of Jamming
+	conf.SetDefault("rfplayer.jammingmediumlevel", "-80")     // RF level (dB) from which a jamming is medium
+	conf.SetDefault("rfplayer.jamminghighlevel", "-60")       // RF level (dB) from which a jamming is high
+	conf.SetDefault("rfplayer.minquality", "0")               // Minimum RF quality of a frame to be decoded
+	conf.SetDefault("rfplayer.dropzeroquality", "false")      // Drop the frames of RF quality 0
+	conf.SetDefault("rfplayer.minrflevel", "-128")            // Minimum RF level (dB) of a frame to be decoded
+	conf.SetDefault("rfplayer.dropprotocolmismatch", "false") // Drop the frames of a sensor with another protocol than its expectedprotocol
+	conf.SetDefault("rfplayer.invalidhumidity", "field")      // Humidity out of 0-100 : field, frame or clamp
+	conf.SetDefault("rfplayer.nosynclogperiod", "60")         // Minimum delay (s) between 2 logs of data without 'ZI'
+	conf.SetDefault("rfplayer.initdelay", "0")                // Delay (ms) before sending the initialisation commands
+	conf.SetDefault("rfplayer.initwaitack", "false")          // Wait for a response of the dongle after each initialisation command
+	conf.SetDefault("rfplayer.initacktimeout", "1000")        // Delay (ms) to wait for this response
+	conf.SetDefault("rfplayer.initretries", "2")              // Number of times a command without response is sent again
+	conf.SetDefault("rfplayer.writechunksize", "0")           // Size of the chunks written to the serial port, 0 for a single write
+	conf.SetDefault("rfplayer.writechunkdelay", "0")          // Delay (ms) between 2 chunks
+	conf.SetDefault("rfplayer.maxcommandspersecond", "0")     // Maximum number of commands sent per second, 0 for no limit
+	conf.SetDefault("rfplayer.ignorecommandsonstartup", "0")  // Delay (s) after the initialisation during which commands are rejected
+	conf.SetDefault("rfplayer.confirmtimeout", "3000")        // Delay (ms) to wait for the state of an actuator reporting back
+	conf.SetDefault("rfplayer.maxsilence", "600")             // Delay (s) without bytes read before the serial link is reported down
+	conf.SetDefault("rfplayer.reopeninterval", "5")           // Delay (s) before reopening the serial port
+	conf.SetDefault("rfplayer.reopenmaxinterval", "300")      // Maximum delay (s) between 2 reopening
+	conf.SetDefault("rfplayer.reopenbackoff", "2")            // Delay multiplier after each failure
+	conf.SetDefault("rfplayer.testdelay", "2000")             // Delay (ms) between on and off in the self-test of the actuators
+	conf.SetDefault("rfplayer.simdelay", "1000")              // Delay (ms) between 2 frames replayed in simulation mode
+	conf.SetDefault("brockermqtt.protocol", "tls")
+	conf.SetDefault("brockermqtt.address", "127.0.0.1")
 	conf.SetDefault("brockermqtt.port", "1883")
 	conf.SetDefault("brockermqtt.username", "username")
 	conf.SetDefault("brockermqtt.password", "password")
 	conf.SetDefault("brockermqtt.certfile", "ca.crt")
 	conf.SetDefault("brockermqtt.insecure", "false")
 	conf.SetDefault("brockermqtt.topicroot", "rfp2mqtt")
+	conf.SetDefault("brockermqtt.autoreconnect", "false")        // Let Paho reconnect instead of the reconnection loop
+	conf.SetDefault("brockermqtt.reconnectinterval", "10")       // Delay (s) before reconnecting
+	conf.SetDefault("brockermqtt.reconnectmaxinterval", "300")   // Maximum delay (s) between 2 reconnections
+	conf.SetDefault("brockermqtt.reconnectbackoff", "2")         // Delay multiplier after each failure
+	conf.SetDefault("brockermqtt.batchwindow", "0")              // Delay (ms) between 2 batch publications, 0 to disable
+	conf.SetDefault("brockermqtt.batchsize", "50")               // Maximum number of readings in a batch
+	conf.SetDefault("brockermqtt.batchtopic", "")                // Batch topic, <topicroot>/batch if empty
+	conf.SetDefault("brockermqtt.batchkeeptopics", "false")      // Also publish each reading on its own topic
+	conf.SetDefault("brockermqtt.payloadformat", "native")       // Format of the readings : native or tasmota
+	conf.SetDefault("brockermqtt.maxpayloadsize", "4096")        // Maximum size of a reading payload, larger readings are dropped, 0 for no limit
+	conf.SetDefault("brockermqtt.timefield", "tc")               // Name of the timestamp field of the readings
+	conf.SetDefault("brockermqtt.asciitopics", "false")          // Transliterate the accented characters of the sensor topics to ASCII
+	conf.SetDefault("brockermqtt.bandtopics", "false")           // Put the band of the frame in the topics of the unknown sensors
+	conf.SetDefault("brockermqtt.gatewayprefix", "")             // Namespace prepended to every topic, for several gateways on one broker
+	conf.SetDefault("brockermqtt.statustopic", "")               // Status topic of the gateway, <topicroot>/status if empty
+	conf.SetDefault("brockermqtt.statusonline", "online")        // Status published, retained, on connection
+	conf.SetDefault("brockermqtt.actuatoravailability", "false") // Publish the availability of each actuator
+	conf.SetDefault("brockermqtt.statusoffline", "offline")      // Status published by the broker when the gateway is lost (last will)
+	conf.SetDefault("brockermqtt.qos", "2")                      // QoS of the readings
+	conf.SetDefault("brockermqtt.retain", "false")               // Retain the readings
+	conf.SetDefault("brockermqtt.watchdogtopic", "")             // Watchdog topic, <topicroot>/watchdog if empty
+	conf.SetDefault("brockermqtt.watchdoginterval", "10")        // Delay (s) between 2 watchdog messages
+	conf.SetDefault("brockermqtt.watchdogqos", "2")              // QoS of the watchdog messages
+	conf.SetDefault("brockermqtt.watchdogretain", "false")       // Retain the last watchdog message
+	conf.SetDefault("brockermqtt.allqualifierbits", "false")     // Publish all the qualifier bits in the bits field
+	conf.SetDefault("brockermqtt.includeidhex", "false")         // Add the raw device ID bytes in hexadecimal
+	conf.SetDefault("brockermqtt.includerfmetrics", "false")     // Add the RF level, floor noise and quality of the frame
+	conf.SetDefault("brockermqtt.includehash", "false")          // Add the CRC32 of the reading in the hash field
+	conf.SetDefault("brockermqtt.ticcountersfile", "")           // File keeping the totals of the TIC counters across restarts
+	conf.SetDefault("brockermqtt.publishschema", "false")        // Publish the JSON schema of the readings on <topicroot>/schema
+	conf.SetDefault("brockermqtt.resyncretained", "false")       // Publish again the last readings on each (re)connection
+	conf.SetDefault("brockermqtt.sensorexpire", "0")             // Delay (s) without reading after which a sensor is expired, 0 to disable
+	conf.SetDefault("brockermqtt.clearonexpire", "false")        // Clear the retained reading of an expired sensor
+	conf.SetDefault("brockermqtt.changeonly", "false")           // Publish a reading only if it changed
+	conf.SetDefault("brockermqtt.maxstale", "0")                 // Maximum delay (s) without publication of a sensor, 0 for no limit
+	conf.SetDefault("brockermqtt.changefields", []string{})      // Fields compared in changeonly mode, all if empty
 	conf.SetDefault("log.format", "ascii")
 	conf.SetDefault("log.output", "stdout")
 	conf.SetDefault("log.level", "info")
+	conf.SetDefault("homeassistant.discovery", "false")      // Announce the sensors to Home Assistant
+	conf.SetDefault("homeassistant.prefix", "homeassistant") // Discovery prefix of Home Assistant
+	conf.SetDefault("sink.type", "mqtt")                     // mqtt, stdout to write the readings as JSON lines or webhook to post them
+	conf.SetDefault("sink.url", "")                          // URL of the webhook
+	conf.SetDefault("sink.method", "POST")                   // HTTP method of the webhook
+	conf.SetDefault("sink.timeout", "5000")                  // Timeout (ms) of a webhook request
+	conf.SetDefault("sink.queuesize", "100")                 // Readings waiting for the webhook, dropped beyond
+	conf.SetDefault("actions.brightnessscale", "100")        // Maximum level of the dim:<level> commands, 255 for Home Assistant
+	conf.SetDefault("http.metrics", "false")                 // Expose the Prometheus metrics on /metrics
+	conf.SetDefault("http.listen", "")                       // Address of the HTTP healthcheck, as :8080, disabled if empty
+	conf.SetDefault("daemon", "false")                       // Run as a daemon, detached from the terminal
+	conf.SetDefault("pidfile", "/var/run/rfp2mqtt.pid")      // PID file written in daemon mode
+	conf.SetDefault("watchconfig", "false")                  // Reload the sensors and actuators when the config file changes
+	conf.SetDefault("test.enabled", "false")                 // Accept fake readings on <topicroot>/test/publish
 
 	/**
 	 * Initialize config parameters passed by command line if present
 	 */
 	flag.StringVar(&flagConfigFile, "c", "UNDEFINED", "Location and name of config file")
+	flag.BoolVar(&flagDaemon, "d", false, "Run as a daemon, detached from the terminal")
 	// insecure = flag.Bool("insecure-ssl", false, "Accept/Ignore all server SSL certificates")
+}
+
+/**
+ * Function that load the config file, the sensors and actuators, and set up the logs
+ * The errors are meant for the end user, who may just have a typo in the YAML file
+ */
+func loadConfig() error {
 	flag.Parse()
 	log.Info("[init] config file which will be used : ", flagConfigFile)
 
@@ -1632,7 +4929,13 @@ func init() {
 	}
 	err := conf.ReadInConfig() // Read the config file
 	if err != nil {            // Handle errors reading the config file
-		panic(fmt.Errorf("Fatal error config file: %s", err))
+		if _, notFound := err.(conf.ConfigFileNotFoundError); notFound {
+			return fmt.Errorf("config file not found : config.yml is searched in the current directory and /dist, or give it with -c <file>")
+		}
+		if os.IsNotExist(err) {
+			return fmt.Errorf("config file not found : %s", flagConfigFile)
+		}
+		return fmt.Errorf("invalid config file %s : %s", conf.ConfigFileUsed(), err)
 	}
 
 	/**
@@ -1640,7 +4943,7 @@ func init() {
 	 */
 	errnew := conf.Unmarshal(&config)
 	if errnew != nil {
-		panic("Unable to unmarshal config")
+		return fmt.Errorf("invalid value in config file %s : %s", conf.ConfigFileUsed(), errnew)
 	}
 
 	/**
@@ -1663,17 +4966,33 @@ func init() {
 		// Can be any io.Writer, see below for File example
 		log.SetOutput(os.Stderr)
 	default:
-		// Output to stdout instead of the default stderr
-		// Can be any io.Writer, see below for File example
-		log.SetOutput(os.Stdout)
+		// Output to the file named by log.output, appended
+		f, err := os.OpenFile(config.Log.Output, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			log.SetOutput(os.Stdout)
+			log.Error("Unable to open log file ", config.Log.Output, ", logs on stdout : ", err)
+		} else {
+			log.SetOutput(f)
+		}
+	}
+
+	// Keep stdout for the readings when used as sink
+	if conf.GetString("sink.type") == "stdout" {
+		log.SetOutput(os.Stderr)
 	}
 
 	logLevel, logerr := log.ParseLevel(config.Log.Level)
 	if logerr != nil {
-		panic(fmt.Errorf("Fatal error parsing level: %s", logerr))
+		levels := []string{}
+		for _, l := range log.AllLevels {
+			levels = append(levels, l.String())
+		}
+		return fmt.Errorf("invalid log level %q, accepted values : %s", config.Log.Level, strings.Join(levels, ", "))
 	}
 
 	log.SetLevel(logLevel)
+
+	return nil
 }
 
 func dumpByteSlice(b []byte) {
@@ -1704,11 +5023,101 @@ func dumpByteSlice(b []byte) {
 	}
 }
 
+/**
+ * Function that create the caches filled while decoding the frames, the last readings for the changeonly mode first
+ */
+func createReadingsCaches() {
+	lastReadingsCache = cache.New(cache.NoExpiration, cache.NoExpiration)
+	pendingConfirmsCache = cache.New(cache.NoExpiration, time.Minute)
+	lastPublishedCache = cache.New(cache.NoExpiration, cache.NoExpiration)
+	staleReadingsCache = cache.New(cache.NoExpiration, cache.NoExpiration)
+	ticCountersCache = cache.New(cache.NoExpiration, cache.NoExpiration)
+	loadTICCounters()
+	supervisionCache = cache.New(cache.NoExpiration, cache.NoExpiration)
+	discoveryCache = cache.New(cache.NoExpiration, cache.NoExpiration)
+	if expire := conf.GetInt("brockermqtt.sensorexpire"); expire > 0 {
+		sensorsSeenCache = cache.New(time.Duration(expire)*time.Second, 10*time.Second)
+		sensorsSeenCache.OnEvicted(sensorExpired)
+	}
+}
+
+/**
+ * Environment variable set for the detached process of the daemon mode
+ */
+const daemonEnv = "RFP2MQTT_DAEMON"
+
+/**
+ * Function that detach the gateway from the terminal
+ * - The process starts itself again in a new session, without terminal, and exits
+ * - The detached process writes its PID in pidfile
+ * The start is refused if pidfile names a running process
+ */
+func daemonize() {
+	pidFile = conf.GetString("pidfile")
+
+	if data, err := ioutil.ReadFile(pidFile); err == nil {
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err == nil && pid != os.Getpid() && syscall.Kill(pid, 0) == nil {
+			log.Fatal("rfp2mqtt already running with PID ", pid, " (", pidFile, ")")
+		}
+	}
+
+	if os.Getenv(daemonEnv) != "1" {
+		executable, err := os.Executable()
+		if err != nil {
+			log.Fatal("Unable to find the executable: ", err)
+		}
+
+		cmd := exec.Command(executable, os.Args[1:]...)
+		cmd.Env = append(os.Environ(), daemonEnv+"=1")
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+		if err := cmd.Start(); err != nil {
+			log.Fatal("Unable to start the daemon: ", err)
+		}
+
+		fmt.Println("rfp2mqtt started as daemon, PID", cmd.Process.Pid)
+		os.Exit(0)
+	}
+
+	if err := ioutil.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		log.Fatal("Unable to write PID file ", pidFile, ": ", err)
+	}
+}
+
 func main() {
 
 	var err error
 	var bparity rfp.ParityMode
 
+	/**
+	 * A wrong config is reported in one line, without the stack trace of a panic
+	 */
+	if err = loadConfig(); err != nil {
+		fmt.Fprintln(os.Stderr, "rfp2mqtt :", err)
+		os.Exit(1)
+	}
+
+	/**
+	 * Detach from the terminal in daemon mode
+	 */
+	if flagDaemon || conf.GetBool("daemon") {
+		daemonize()
+	}
+
+	/**
+	 * Healthcheck for the supervision (Docker, Kubernetes), answering 503 until the gateway is up
+	 */
+	if conf.GetString("http.listen") != "" {
+		go healthServer()
+	}
+
+	/**
+	 * Hot reload of the sensors and actuators, the serial port and the MQTT connection are kept
+	 */
+	if conf.GetBool("watchconfig") {
+		watchConfig()
+	}
+
 	/**
 	 * Serial configuration with RFPLAYER dongle
 	 */
@@ -1738,34 +5147,40 @@ func main() {
 	log.Info("InterCharacterTimeout ", uint(conf.GetInt("rfplayer.timeout")))
 	log.Info("RTSCTSFlowControl ", conf.GetBool("rfplayer.rtsctsflowcontrol"))
 
-	rfpPort, err = rfp.Open(options)
+	rfpConfig = options
+	if port := conf.GetString("rfplayer.port"); strings.HasPrefix(port, simPortScheme) {
+		log.Info("[SIM] Simulation mode, no dongle")
+		simFrames, err = openSimPort(strings.TrimPrefix(port, simPortScheme))
+		rfpPort = simFrames
+	} else {
+		rfpPort, err = openSerialPort()
+	}
 
 	if err != nil {
-		log.Error("Error opening serial port ", conf.GetString("rfplayer.port"), " : ", err)
+		logSerialOpenError(err)
 		os.Exit(-1)
 	} else {
 		log.Info("Connection done to RFPlayer dongle on port ", conf.GetString("rfplayer.port"))
+		atomic.StoreInt32(&serialUp, 1)
+		atomic.StoreInt64(&lastBytesTime, time.Now().Unix())
 		defer rfpPort.Close()
 	}
 
 	/**
-	 * Default configuration of RFPLAYER dongle by sending command in config.yml
+	 * Setup time between 2 send message to RFP
 	 */
-	tData := []byte("")
-	for i := 0; i < len(config.Rfplayer.Initialisation); i++ {
-		tData = []byte(config.Rfplayer.Initialisation[i].Cmd + "\x00")
-		count, err := rfpPort.Write(tData)
-		if err != nil {
-			log.Error("Error writing to serial port: ", err)
-		} else {
-			log.Debug("Wrote ", count, " bytes : ", string(tData[:]))
-		}
-	}
+	iWait2Send = config.Rfplayer.WaitToSend
 
 	/**
-	 * Setup time between 2 send message to RFP
+	 * Handle the reopening of the serial port
 	 */
-	iWait2Send = config.Rfplayer.WaitToSend
+	serialLost = make(chan error, 1)
+	go serialReopen()
+
+	/**
+	 * Create the caches of the readings
+	 */
+	createReadingsCaches()
 
 	/**
 	 * Openning reception
@@ -1775,32 +5190,78 @@ func main() {
 		go receive(rfpPort)
 	}
 
+	/**
+	 * Default configuration of RFPLAYER dongle by sending command in config.yml
+	 * Reception is already opened to read the acknowledgements
+	 */
+	initAcks = make(chan string, 1)
+	if simFrames == nil {
+		sendInitialisation(rfpPort)
+	}
+	atomic.StoreInt64(&initDone, time.Now().UnixNano())
+
 	/**
 	 * Create the channel for incoming messages
 	 */
-	ch = make(chan []byte, 100)
+	ch = make(chan command, 100)
 
 	/**
 	 * Launch the emit process
 	 */
-	go emit(rfpPort)
+	go emit(serialPort)
 
 	/**
-	 * Setup MQTT
+	 * Stop cleanly on SIGINT (CTRL/C) or SIGTERM (systemctl stop)
+	 */
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		shutdown(<-signals)
+	}()
+
+	/**
+	 * Readings are posted to a webhook, by a bounded queue not to stall the reception
+	 */
+	if conf.GetString("sink.type") == "webhook" {
+		webhookQueue = make(chan string, conf.GetInt("sink.queuesize"))
+		go webhookSender()
+	}
+
+	/**
+	 * Readings are written on stdout, no need of MQTT
+	 */
+	if conf.GetString("sink.type") == "stdout" {
+		log.Info("Sink stdout, MQTT disabled")
+		select {}
+	}
+
+	/**
+	 * Setup MQTT and handle the reconnection
 	 */
 	mqttSetupAndConnect()
+	if !conf.GetBool("brockermqtt.autoreconnect") {
+		go mqttReconnect()
+	}
 
 	/**
-	 * Sending a watchdog message every 10 seconds
-	 * check if connected, if not, try reconnecting
+	 * Launch the batch publication if enabled
+	 */
+	if conf.GetInt("brockermqtt.batchwindow") > 0 {
+		go batchFlusher()
+	}
+
+	/**
+	 * Launch the publication of the stale readings
+	 */
+	go staleRepublisher()
+
+	/**
+	 * Sending a watchdog message every brockermqtt.watchdoginterval seconds if connected
 	 */
 	for {
-		time.Sleep(10 * time.Second)
+		time.Sleep(time.Duration(conf.GetInt("brockermqtt.watchdoginterval")) * time.Second)
 		if cmqtt.IsConnectionOpen() {
-			go publish("rfplayer/watchdog", time.Now().Format(time.RFC3339))
-		} else {
-			// Try reconnecting
-			mqttSetupAndConnect()
+			go publishMessage(watchdogTopic(), byte(conf.GetInt("brockermqtt.watchdogqos")), conf.GetBool("brockermqtt.watchdogretain"), watchdogMessage())
 		}
 	}
 }
@@ -0,0 +1,974 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	rfp "github.com/jacobsa/go-serial/serial"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	log "github.com/sirupsen/logrus"
+	conf "github.com/spf13/viper"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+/**
+ * Function that load a YAML config as the config file would, with the caches of the sensors, actuators and readings
+ * The options are set on top of it, and restored after the test
+ */
+func setupConfig(t testing.TB, yaml string, options map[string]interface{}) {
+	t.Helper()
+
+	conf.SetConfigType("yaml")
+	if err := conf.ReadConfig(bytes.NewBufferString(yaml)); err != nil {
+		t.Fatalf("reading config: %s", err)
+	}
+	config = Config{}
+	if err := conf.Unmarshal(&config); err != nil {
+		t.Fatalf("unmarshalling config: %s", err)
+	}
+
+	for k, v := range options {
+		previous := conf.Get(k)
+		conf.Set(k, v)
+		t.Cleanup(func() { conf.Set(k, previous) })
+	}
+
+	loadSensors()
+	loadActuators()
+	sensorsSeenCache = nil // Only created with brockermqtt.sensorexpire
+	createReadingsCaches()
+}
+
+/**
+ * Function that build a binary frame as sent by the dongle, with the infos words of the layout of its infosType
+ * The frame header is RFLevel -64 dBm, FloorNoise -96 dBm, RFQuality 5 on 433 MHz
+ */
+func testFrame(infosType byte, protocol byte, words ...uint16) []byte {
+	m := []byte{'Z', 'I', 0, 0, 0, regularIncomingBinaryUSBFrameType, 0, 0, 0xC0, 0xA0, 5, protocol, infosType}
+	for _, w := range words {
+		m = binary.LittleEndian.AppendUint16(m, w)
+	}
+	binary.LittleEndian.PutUint16(m[3:], uint16(len(m)-5))
+
+	return m
+}
+
+/**
+ * Function that decode a frame and return its topic and fields, the timestamp removed
+ */
+func decodeTestFrame(t *testing.T, m []byte) (string, map[string]interface{}) {
+	t.Helper()
+
+	r, ok := decodeFrame(len(m), m)
+	if !ok {
+		t.Fatalf("frame %x not decoded", m)
+	}
+
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(r.Payload), &fields); err != nil {
+		t.Fatalf("payload %s: %s", r.Payload, err)
+	}
+	if _, found := fields[timeField()]; !found {
+		t.Errorf("payload %s without timestamp", r.Payload)
+	}
+	delete(fields, timeField())
+
+	return r.Topic, fields
+}
+
+/**
+ * Function that add the fields common to all readings to the expected ones
+ */
+func withCommonFields(ref string, subType string, protocol string, fields map[string]interface{}) map[string]interface{} {
+	fields["v"] = float64(payloadVersion)
+	fields["n"] = ref
+	fields["r"] = ref
+	fields["st"] = subType
+	fields["srcdest"] = "0"
+	fields["protocol"] = protocol
+
+	return fields
+}
+
+/**
+ * Reference frames of each infosType, built from the layouts of incomingRFInfosType0 to incomingRFInfosType15
+ */
+func TestDecodeReferenceFrames(t *testing.T) {
+	tests := []struct {
+		name   string
+		frame  []byte
+		topic  string
+		fields map[string]interface{}
+	}{
+		{
+			"X10 ON", testFrame(infosType0, receivedProtocolX10, 1, 2, 0),
+			"rfp2mqtt/131073/x10",
+			withCommonFields("131073", "131073", "X10", map[string]interface{}{}),
+		},
+		{
+			"CHACON ON", testFrame(infosType1, receivedProtocolCHACON, 1, 0x5678, 0x0012),
+			"rfp2mqtt/1-1201784/chacon",
+			withCommonFields("1-1201784", "1450704897", "CHACON", map[string]interface{}{
+				"devicetype": "switch",
+			}),
+		},
+		{
+			"EDISIO on infosType 0", testFrame(infosType0, receivedProtocolEDISIO, 3, 4, 0),
+			"rfp2mqtt/262147/edisio",
+			withCommonFields("262147", "262147", "EDISIO", map[string]interface{}{}),
+		},
+		{
+			"EDISIO on infosType 1", testFrame(infosType1, receivedProtocolEDISIO, 1, 0x9ABC, 0x0012),
+			"rfp2mqtt/1-1219260/edisio",
+			withCommonFields("1-1219260", "2596012033", "EDISIO", map[string]interface{}{}),
+		},
+		{
+			"VISONIC alarm", testFrame(infosType2, receivedProtocolVISONIC, 0, 0x1234, 0, 0x0002),
+			"rfp2mqtt/2-4660/visonic",
+			withCommonFields("2-4660", "305397760", "VISONIC", map[string]interface{}{
+				"q": "2", "ftamper": "0", "falarm": "1", "flowbatt": "0", "falive": "0",
+			}),
+		},
+		{
+			"RTS", testFrame(infosType3, receivedProtocolRFY, 0, 0x2222, 0x0001, 1),
+			"rfp2mqtt/3-74274/rts",
+			withCommonFields("3-74274", "572653568", "RTS", map[string]interface{}{
+				"q": "1",
+			}),
+		},
+		{
+			"OREGON thermo/hygro", testFrame(infosType4, receivedProtocolOREGON, 0x1A2D, 0x00CC, 1, 0, 215, 48),
+			"rfp2mqtt/4-13369345/th",
+			withCommonFields("4-13369345", "13376045", "OREGON", map[string]interface{}{
+				"t": "21.5", "h": "48", "flowbatt": "0",
+			}),
+		},
+		{
+			"OREGON pressure", testFrame(infosType5, receivedProtocolOREGON, 0x5A6D, 0x0010, 2, 1, 200, 55, 1013),
+			"rfp2mqtt/5-1048578/thpa",
+			withCommonFields("5-1048578", "1071725", "OREGON", map[string]interface{}{
+				"t": "20.0", "h": "55", "p": "1013", "flowbatt": "1",
+			}),
+		},
+		{
+			"OREGON wind", testFrame(infosType6, receivedProtocolOREGON, 0x1984, 0x0020, 3, 0, 213, 270),
+			"rfp2mqtt/6-2097155/wind",
+			withCommonFields("6-2097155", "2103684", "OREGON", map[string]interface{}{
+				"s": "213", "d": "270", "flowbatt": "0",
+			}),
+		},
+		{
+			"OREGON UV", testFrame(infosType7, receivedProtocolOREGON, 0xD874, 0x0030, 1, 0, 5),
+			"rfp2mqtt/7-3145729/uv",
+			withCommonFields("7-3145729", "3201140", "OREGON", map[string]interface{}{
+				"l": "5", "flowbatt": "0",
+			}),
+		},
+		{
+			"OWL", testFrame(infosType8, receivedProtocolOWL, 0, 0x0040, 1, 0, 1000, 1, 1500, 500, 600, 400),
+			"rfp2mqtt/8-4194305/owl",
+			withCommonFields("8-4194305", "4194304", "OWL", map[string]interface{}{
+				"e": "66536", "p": "1500", "pi1": "500", "pi2": "600", "pi3": "400", "channel": "1", "flowbatt": "0",
+			}),
+		},
+		{
+			"OREGON rain", testFrame(infosType9, receivedProtocolOREGON, 0x2914, 0x0050, 1, 0, 1234, 0, 56),
+			"rfp2mqtt/9-5242881/rain",
+			withCommonFields("9-5242881", "5253396", "OREGON", map[string]interface{}{
+				"tra": "1234", "ra": "56", "flowbatt": "0",
+			}),
+		},
+		{
+			"X2D thermostat", testFrame(infosType10, receivedProtocolX2D, 0, 0x1111, 0, 0x0004, 1, 2, 0),
+			"rfp2mqtt/10-4369/x2dcontact",
+			withCommonFields("10-4369", "286326784", "X2D", map[string]interface{}{
+				"q": "4", "ftamper": "0", "fanomaly": "0", "flowbatt": "1", "ftestassoc": "0", "fdomestic": "0",
+			}),
+		},
+		{
+			"X2D shutter", testFrame(infosType11, receivedProtocolX2D, 0, 0x2222, 0, 0, 1, 0, 0),
+			"rfp2mqtt/11-8738/x2dshutter",
+			withCommonFields("11-8738", "572653568", "X2D", map[string]interface{}{
+				"q": "0", "ftamper": "0", "fanomaly": "0", "flowbatt": "0", "ftestassoc": "0", "fdomestic": "0",
+			}),
+		},
+		{
+			"DIGIMAX", testFrame(infosType12, receivedProtocolDIGIMAX, 0, 0x3333, 0, 0, 0xFFE0, 200),
+			"rfp2mqtt/12-13107/null",
+			withCommonFields("12-13107", "858980352", "DEPRECATED", map[string]interface{}{
+				"q": "0", "t": "-3.2",
+			}),
+		},
+		{
+			"Teleinfo", testFrame(infosType13, receivedProtocolTIC, 0, 0x5678, 0x1234, 0x0201, 1, 0xCD15, 0x075B, 0x1206, 0x000F, 2300),
+			"rfp2mqtt/13-8895354488/linky",
+			withCommonFields("13-8895354488", "1450704896", "LINKY", map[string]interface{}{
+				"q": "1", "ct": "1", "cnt1": "123456789", "cnt2": "987654",
+				"cnt1_total": "123456789", "cnt2_total": "987654", "rollover": "0", "ap": "2300",
+			}),
+		},
+		{
+			"FS20", testFrame(infosType14, receivedProtocolFS20, 0, 0x4444, 0, 1),
+			"rfp2mqtt/14-17476/fs20",
+			withCommonFields("14-17476", "1145307136", "FS20", map[string]interface{}{
+				"q": "1",
+			}),
+		},
+		{
+			"JAMMING", testFrame(infosType15, receivedProtocolJAMMING, 1, 0, 0),
+			"rfp2mqtt/15-0/jamming",
+			withCommonFields("15-0", "1", "JAMMING", map[string]interface{}{
+				"s": "1", "severity": "medium",
+			}),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupConfig(t, "", nil)
+
+			topic, fields := decodeTestFrame(t, tt.frame)
+			if topic != tt.topic {
+				t.Errorf("topic %s, expected %s", topic, tt.topic)
+			}
+			if !reflect.DeepEqual(fields, tt.fields) {
+				t.Errorf("fields %v, expected %v", fields, tt.fields)
+			}
+		})
+	}
+}
+
+/**
+ * The frames of an infosType without decoder are published raw on the unknown topic
+ */
+func TestDecodeUnknownInfosType(t *testing.T) {
+	setupConfig(t, "", nil)
+
+	m := testFrame(42, receivedProtocolX10, 1, 2, 3)
+	topic, fields := decodeTestFrame(t, m)
+	if topic != "rfp2mqtt/unknown" {
+		t.Errorf("topic %s, expected rfp2mqtt/unknown", topic)
+	}
+	if fields["infostype"] != "42" || fields["frametype"] != "0" || fields["raw"] != hex.EncodeToString(m) {
+		t.Errorf("fields %v", fields)
+	}
+}
+
+/**
+ * Serial port returning the given reads one after the other, then an error to end receive
+ */
+type scriptedPort struct {
+	reads [][]byte
+}
+
+func (p *scriptedPort) Read(b []byte) (int, error) {
+	if len(p.reads) == 0 {
+		return 0, errors.New("no more reads")
+	}
+	n := copy(b, p.reads[0])
+	p.reads = p.reads[1:]
+
+	return n, nil
+}
+
+func (p *scriptedPort) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (p *scriptedPort) Close() error {
+	return nil
+}
+
+/**
+ * Reference frames as seeds of the fuzz targets
+ */
+var fuzzSeedFrames = [][]byte{
+	testFrame(infosType0, receivedProtocolX10, 1, 2, 0),
+	testFrame(infosType4, receivedProtocolOREGON, 0x1A2D, 0x00CC, 1, 0, 215, 48),
+	testFrame(infosType8, receivedProtocolOWL, 0, 0x0040, 1, 0, 1000, 1, 1500, 500, 600, 400),
+	testFrame(infosType13, receivedProtocolTIC, 0, 0x5678, 0x1234, 0x0201, 1, 0xCD15, 0x075B, 0x1206, 0x000F, 2300),
+	[]byte("ZIA33 RECEIVED PROTOCOLS: X10 RTS\r"),
+}
+
+/**
+ * Any frame, whatever its length and content, is decoded or dropped without panic
+ */
+func FuzzDecode(f *testing.F) {
+	setupConfig(f, "", nil)
+	for _, m := range fuzzSeedFrames {
+		f.Add(m)
+	}
+
+	f.Fuzz(func(t *testing.T, m []byte) {
+		decode(len(m), m)
+	})
+}
+
+/**
+ * Any byte stream, split in two reads, is framed without panic and receive returns on the read error
+ */
+func FuzzReceiveFraming(f *testing.F) {
+	setupConfig(f, "", nil)
+	for _, m := range fuzzSeedFrames {
+		f.Add(append(append([]byte{}, m...), m...), len(m))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte, split int) {
+		if split < 0 || split > len(data) {
+			split = len(data) / 2
+		}
+		receive(&scriptedPort{[][]byte{data[:split], data[split:]}})
+	})
+}
+
+/**
+ * The frames truncated below the length of their infosType are dropped without panic
+ */
+func TestDecodeTruncatedFrames(t *testing.T) {
+	setupConfig(t, "", nil)
+
+	for infosType, minLength := range infosTypeMinLength {
+		t.Run(strconv.Itoa(int(infosType)), func(t *testing.T) {
+			m := testFrame(infosType, 0, make([]uint16, 16)...)
+			for l := 0; l < minLength; l++ {
+				if _, ok := decodeFrame(l, m[:l]); ok {
+					t.Errorf("frame of %d bytes decoded, minimum %d", l, minLength)
+				}
+			}
+			if _, ok := decodeFrame(minLength, m[:minLength]); !ok {
+				t.Errorf("frame of %d bytes not decoded", minLength)
+			}
+		})
+	}
+}
+
+/**
+ * Two frames arriving back-to-back in a single read are both decoded
+ */
+func TestReceiveTwoFramesInOneRead(t *testing.T) {
+	setupConfig(t, "", map[string]interface{}{"brockermqtt.sensorexpire": 60})
+
+	th := testFrame(infosType4, receivedProtocolOREGON, 0x1A2D, 0x00CC, 1, 0, 215, 48)
+	uv := testFrame(infosType7, receivedProtocolOREGON, 0xD874, 0x0030, 1, 0, 5)
+	receive(&scriptedPort{[][]byte{append(append([]byte{}, th...), uv...)}})
+
+	for _, topic := range []string{"rfp2mqtt/4-13369345/th", "rfp2mqtt/7-3145729/uv"} {
+		if _, found := sensorsSeenCache.Get(topic); !found {
+			t.Errorf("reading of %s not decoded", topic)
+		}
+	}
+}
+
+/**
+ * A frame preceded by noise is only extracted once complete, then the next frames of the same read are decoded too
+ */
+func TestReceiveFramesAfterNoise(t *testing.T) {
+	setupConfig(t, "", map[string]interface{}{"brockermqtt.sensorexpire": 60})
+
+	th := testFrame(infosType4, receivedProtocolOREGON, 0x1A2D, 0x00CC, 1, 0, 215, 48)
+	uv := testFrame(infosType7, receivedProtocolOREGON, 0xD874, 0x0030, 1, 0, 5)
+	rain := testFrame(infosType9, receivedProtocolOREGON, 0x2914, 0x0050, 1, 0, 1234, 0, 56)
+	noise := []byte{0x00, 0x13, 0x37}
+
+	first := append(append([]byte{}, noise...), th[:len(th)-len(noise)]...)
+	second := append(append(append([]byte{}, th[len(th)-len(noise):]...), uv...), rain...)
+	receive(&scriptedPort{[][]byte{first, second}})
+
+	for _, topic := range []string{"rfp2mqtt/4-13369345/th", "rfp2mqtt/7-3145729/uv", "rfp2mqtt/9-5242881/rain"} {
+		if _, found := sensorsSeenCache.Get(topic); !found {
+			t.Errorf("reading of %s not decoded", topic)
+		}
+	}
+}
+
+/**
+ * The temperatures below 0 °C, in two's complement, are published signed
+ */
+func TestDecodeNegativeTemperature(t *testing.T) {
+	setupConfig(t, "", nil)
+
+	frames := map[string][]byte{
+		"OREGON thermo/hygro": testFrame(infosType4, receivedProtocolOREGON, 0x1A2D, 0x00CC, 1, 0, 0xFFE0, 48),
+		"OREGON pressure":     testFrame(infosType5, receivedProtocolOREGON, 0x5A6D, 0x0010, 2, 0, 0xFFE0, 55, 1013),
+		"DIGIMAX":             testFrame(infosType12, receivedProtocolDIGIMAX, 0, 0x3333, 0, 0, 0xFFE0, 200),
+	}
+	for name, m := range frames {
+		t.Run(name, func(t *testing.T) {
+			r, ok := decodeFrame(len(m), m)
+			if !ok {
+				t.Fatalf("frame %x not decoded", m)
+			}
+			if !strings.Contains(r.Payload, `"t":"-3.2"`) {
+				t.Errorf("payload %s without \"t\":\"-3.2\"", r.Payload)
+			}
+		})
+	}
+}
+
+/**
+ * Teleinfo frame of a HC/HP contract, the 5th byte of the id in D8-15 of the qualifier
+ * Built from the layout of incomingRFInfosType13, with the values displayed by the meter
+ */
+func TestDecodeTeleinfo(t *testing.T) {
+	setupConfig(t, "", nil)
+
+	m := testFrame(infosType13, receivedProtocolTIC, 0, 0xDEF0, 0x9ABC, 0x0400, 2, 0x614E, 0x00BC, 0xEC15, 0x0165, 1850)
+	topic, fields := decodeTestFrame(t, m)
+	if topic != "rfp2mqtt/13-19775938288/linky" {
+		t.Errorf("topic %s, expected rfp2mqtt/13-19775938288/linky", topic)
+	}
+	expected := map[string]interface{}{"r": "13-19775938288", "ct": "2", "cnt1": "12345678", "cnt2": "23456789", "ap": "1850"}
+	for k, v := range expected {
+		if fields[k] != v {
+			t.Errorf("%s %v, expected %s", k, fields[k], v)
+		}
+	}
+}
+
+/**
+ * Solar export on a production meter, its subtype listed in protocols.ticsignedsubtypes: ap is negative
+ * The same value is published unsigned for the other subtypes
+ */
+func TestDecodeTeleinfoSolarExport(t *testing.T) {
+	setupConfig(t, "protocols:\n  ticsignedsubtypes: [ \"1\" ]\n", nil)
+
+	tests := map[uint16]string{1: "-1200", 0: "64336"}
+	for subType, ap := range tests {
+		m := testFrame(infosType13, receivedProtocolTIC, subType, 0x5678, 0x1234, 0x0000, 1, 0xCD15, 0x075B, 0, 0, uint16(0x10000-1200))
+		_, fields := decodeTestFrame(t, m)
+		if fields["ap"] != ap {
+			t.Errorf("subtype %d: ap %v, expected %s", subType, fields["ap"], ap)
+		}
+	}
+}
+
+/**
+ * Dual probe OREGON thermometer, its subtype listed in protocols.oregontemp2subtypes: temp2_c instead of the humidity
+ */
+func TestDecodeOregonDualProbe(t *testing.T) {
+	setupConfig(t, "protocols:\n  oregontemp2subtypes: [ \"6701\" ]\n", nil)
+
+	m := testFrame(infosType4, receivedProtocolOREGON, 0x1A2D, 0x00CC, 1, 0, 265, 182)
+	_, fields := decodeTestFrame(t, m)
+	if fields["t"] != "26.5" || fields["temp2_c"] != "18.2" {
+		t.Errorf("t %v and temp2_c %v, expected 26.5 and 18.2", fields["t"], fields["temp2_c"])
+	}
+	if _, found := fields["h"]; found {
+		t.Errorf("humidity %v published for a dual probe", fields["h"])
+	}
+}
+
+/**
+ * A frame of a sensor received with another protocol than its expectedprotocol is dropped with rfplayer.dropprotocolmismatch
+ */
+func TestDecodeProtocolMismatch(t *testing.T) {
+	setupConfig(t, "sensors:\n  - id: 4-13369345\n    name: salon\n    expectedprotocol: X10\n", map[string]interface{}{"rfplayer.dropprotocolmismatch": true})
+
+	m := testFrame(infosType4, receivedProtocolOREGON, 0x1A2D, 0x00CC, 1, 0, 215, 48)
+	if _, ok := decodeFrame(len(m), m); ok {
+		t.Errorf("OREGON frame of a sensor expecting X10 decoded")
+	}
+}
+
+/**
+ * The shutter_action of an X2D shutter frame is only published for the function words of protocols.x2dshutteractions
+ */
+func TestDecodeX2DShutterActions(t *testing.T) {
+	setupConfig(t, "protocols:\n  x2dshutteractions:\n    \"1\": open\n", nil)
+
+	for function, expected := range map[uint16]string{1: "open", 2: ""} {
+		_, fields := decodeTestFrame(t, testFrame(infosType11, receivedProtocolX2D, 0, 0x2222, 0, 0, function, 0, 0))
+		if action, _ := fields["shutter_action"].(string); action != expected {
+			t.Errorf("function %d: shutter_action %q, expected %q", function, action, expected)
+		}
+	}
+}
+
+/**
+ * The relay_state of an X2D contactor frame comes from the built-in mapping of the function 12, completed by protocols.x2drelaystates
+ */
+func TestDecodeX2DRelayState(t *testing.T) {
+	setupConfig(t, "protocols:\n  x2drelaystates:\n    \"12:4\": stop\n    \"12:5\": off\n", nil)
+
+	for mode, expected := range map[uint16]string{0: "hc", 3: "hp", 4: "stop", 5: "off", 1: ""} {
+		_, fields := decodeTestFrame(t, testFrame(infosType10, receivedProtocolX2D, 0, 0x1111, 0, 0, 12, mode, 0))
+		if state, _ := fields["relay_state"].(string); state != expected {
+			t.Errorf("mode %d: relay_state %q, expected %q", mode, state, expected)
+		}
+	}
+}
+
+/**
+ * The BRIGHT and DIM subtypes of a CHACON frame are published with the dimmer device type
+ */
+func TestDecodeChaconDimmer(t *testing.T) {
+	setupConfig(t, "", nil)
+
+	for _, subType := range []uint16{2, 3} {
+		_, fields := decodeTestFrame(t, testFrame(infosType1, receivedProtocolCHACON, subType, 0x5678, 0x0012))
+		if fields["devicetype"] != "dimmer" {
+			t.Errorf("subtype %d: devicetype %v, expected dimmer", subType, fields["devicetype"])
+		}
+	}
+}
+
+/**
+ * The topicroot of the config is the prefix of the topics, with the brockermqtt spelling or the deprecated brokermqtt one
+ */
+func TestDecodeTopicRoot(t *testing.T) {
+	for _, section := range []string{"brockermqtt", "brokermqtt"} {
+		t.Run(section, func(t *testing.T) {
+			setupConfig(t, section+":\n  topicroot: maison\n", nil)
+
+			m := testFrame(infosType4, receivedProtocolOREGON, 0x1A2D, 0x00CC, 1, 0, 215, 48)
+			if topic, _ := decodeTestFrame(t, m); topic != "maison/4-13369345/th" {
+				t.Errorf("topic %s, expected maison/4-13369345/th", topic)
+			}
+		})
+	}
+}
+
+/**
+ * With brockermqtt.changeonly and brockermqtt.includehash, the same reading is published once
+ */
+func TestDecodeChangeOnlyWithHash(t *testing.T) {
+	setupConfig(t, "", map[string]interface{}{"brockermqtt.changeonly": true, "brockermqtt.includehash": true})
+
+	m := testFrame(infosType4, receivedProtocolOREGON, 0x1A2D, 0x00CC, 1, 0, 215, 48)
+	if r, ok := decodeFrame(len(m), m); !ok || !strings.Contains(r.Payload, `"hash":`) {
+		t.Fatalf("first reading not published with its hash")
+	}
+	if _, ok := decodeFrame(len(m), m); ok {
+		t.Errorf("unchanged reading published again")
+	}
+
+	m = testFrame(infosType4, receivedProtocolOREGON, 0x1A2D, 0x00CC, 1, 0, 216, 48)
+	if _, ok := decodeFrame(len(m), m); !ok {
+		t.Errorf("changed reading not published")
+	}
+}
+
+/**
+ * The class of the contacts comes from the deviceclass of the sensor, not from its type used in the topic
+ */
+func TestDiscoveryContactDeviceClass(t *testing.T) {
+	setupConfig(t, "sensors:\n  - id: 2-4660\n    type: binary_sensor\n    deviceclass: door\n  - id: 2-4661\n    type: binary_sensor\n", nil)
+
+	tests := map[string]string{"2-4660": "door", "2-4661": "opening"}
+	for ref, class := range tests {
+		entity, found := discoveryEntityOf("falarm", infosType2, ref)
+		if !found || entity.Component != "binary_sensor" || entity.DeviceClass != class {
+			t.Errorf("%s: entity %+v, expected a binary_sensor of class %s", ref, entity, class)
+		}
+	}
+}
+
+/**
+ * Serial port sending the bytes written on a channel
+ */
+type recordingPort struct {
+	written chan []byte
+}
+
+func (p *recordingPort) Read(b []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (p *recordingPort) Write(b []byte) (int, error) {
+	p.written <- append([]byte{}, b...)
+	return len(b), nil
+}
+
+func (p *recordingPort) Close() error {
+	return nil
+}
+
+/**
+ * emit writes each command to the serial port current at that time, as replaced by serialReopen
+ */
+func TestEmitReopenedPort(t *testing.T) {
+	setupConfig(t, "", nil)
+
+	first := &recordingPort{make(chan []byte, 1)}
+	second := &recordingPort{make(chan []byte, 1)}
+	setSerialPort(first)
+	atomic.StoreInt32(&serialUp, 1)
+	t.Cleanup(func() {
+		atomic.StoreInt32(&serialUp, 0)
+		setSerialPort(nil)
+	})
+
+	ch = make(chan command, 1)
+	go emit(serialPort)
+
+	queueCommand(command{"salon", []byte("ZIA++ON X10 A1\r")})
+	if b := <-first.written; string(b) != "ZIA++ON X10 A1\r" {
+		t.Errorf("%q written to the first port", b)
+	}
+
+	setSerialPort(second)
+	queueCommand(command{"salon", []byte("ZIA++OFF X10 A1\r")})
+	if b := <-second.written; string(b) != "ZIA++OFF X10 A1\r" {
+		t.Errorf("%q written to the reopened port", b)
+	}
+}
+
+/**
+ * A command dequeued by emit is waited for until written, as done on shutdown before closing the port
+ */
+func TestWaitCommandsSent(t *testing.T) {
+	setupConfig(t, "", nil)
+
+	port := &recordingPort{make(chan []byte)} // Write blocks until the frame is read
+	setSerialPort(port)
+	atomic.StoreInt32(&serialUp, 1)
+	t.Cleanup(func() {
+		atomic.StoreInt32(&serialUp, 0)
+		setSerialPort(nil)
+	})
+
+	ch = make(chan command, 1)
+	go emit(serialPort)
+
+	queueCommand(command{"salon", []byte("ZIA++ON X10 A1\r")})
+	if waitCommandsSent(200 * time.Millisecond) {
+		t.Errorf("command not written yet reported sent")
+	}
+
+	<-port.written
+	if !waitCommandsSent(time.Second) {
+		t.Errorf("command written reported not sent")
+	}
+}
+
+/**
+ * MQTT message received on a topic, as delivered to the handlers
+ */
+type testMessage struct {
+	topic   string
+	payload []byte
+}
+
+func (m *testMessage) Duplicate() bool   { return false }
+func (m *testMessage) Qos() byte         { return 0 }
+func (m *testMessage) Retained() bool    { return false }
+func (m *testMessage) Topic() string     { return m.topic }
+func (m *testMessage) MessageID() uint16 { return 0 }
+func (m *testMessage) Payload() []byte   { return m.payload }
+func (m *testMessage) Ack()              {}
+
+/**
+ * The source-dest byte of the frame sent to an actuator is its sourcedest, 433/868 by default
+ */
+func TestCommandSourceDest(t *testing.T) {
+	yaml := "actuators:\n  - name: prise\n    id: A1\n    protocol: x10\n  - name: volet\n    id: A2\n    protocol: x10\n    sourcedest: 2\n"
+	setupConfig(t, yaml, map[string]interface{}{"rfplayer.ignorecommandsonstartup": 0})
+
+	atomic.StoreInt32(&serialUp, 1)
+	atomic.StoreInt64(&initDone, time.Now().UnixNano())
+	t.Cleanup(func() {
+		atomic.StoreInt32(&serialUp, 0)
+		atomic.StoreInt64(&initDone, 0)
+	})
+
+	for name, expected := range map[string]byte{"prise": sourceDest433868, "volet": 2} {
+		ch = make(chan command, 1)
+		fMqttMsgHandler(nil, &testMessage{"home/action/" + name, []byte("1")})
+		select {
+		case c := <-ch:
+			atomic.AddInt32(&emitting, -1)
+			if c.Frame[2] != expected {
+				t.Errorf("%s: source-dest %d, expected %d", name, c.Frame[2], expected)
+			}
+		default:
+			t.Errorf("%s: no command queued", name)
+		}
+	}
+}
+
+/**
+ * MQTT client counting the calls changing its session, the other calls are not expected
+ * The connection is reported closed, so that nothing is published
+ */
+type sessionClient struct {
+	mqtt.Client
+	calls int32
+}
+
+func (c *sessionClient) IsConnected() bool      { return true }
+func (c *sessionClient) IsConnectionOpen() bool { return false }
+func (c *sessionClient) Connect() mqtt.Token    { atomic.AddInt32(&c.calls, 1); return nil }
+func (c *sessionClient) Disconnect(uint)        { atomic.AddInt32(&c.calls, 1) }
+func (c *sessionClient) Subscribe(string, byte, mqtt.MessageHandler) mqtt.Token {
+	atomic.AddInt32(&c.calls, 1)
+	return nil
+}
+func (c *sessionClient) Unsubscribe(...string) mqtt.Token { atomic.AddInt32(&c.calls, 1); return nil }
+
+/**
+ * A serial port reported lost is reopened by serialReopen without disconnecting, replacing or resubscribing the MQTT client
+ */
+func TestSerialReopenKeepsMQTTClient(t *testing.T) {
+	setupConfig(t, "", map[string]interface{}{"rfplayer.reopeninterval": 0, "rfplayer.rx": false, "rfplayer.initdelay": 0})
+
+	client := &sessionClient{}
+	reopened := &recordingPort{make(chan []byte, 10)}
+	savedClient, savedOpen, savedLost := cmqtt, rfpOpen, serialLost
+	cmqtt = client
+	rfpOpen = func(rfp.OpenOptions) (io.ReadWriteCloser, error) { return reopened, nil }
+	serialLost = make(chan error, 1)
+	setSerialPort(&recordingPort{make(chan []byte, 10)})
+	atomic.StoreInt32(&serialUp, 1)
+	atomic.StoreInt64(&initDone, 0)
+	t.Cleanup(func() {
+		cmqtt, rfpOpen, serialLost = savedClient, savedOpen, savedLost
+		atomic.StoreInt32(&serialUp, 0)
+		atomic.StoreInt64(&initDone, 0)
+		setSerialPort(nil)
+	})
+
+	go serialReopen()
+	reportSerialLost(errors.New("device unplugged"))
+
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt64(&initDone) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("serial port not reopened")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if serialPort() != reopened {
+		t.Errorf("serial port not replaced by the reopened one")
+	}
+	if cmqtt != client {
+		t.Errorf("MQTT client replaced while reopening the serial port")
+	}
+	if n := atomic.LoadInt32(&client.calls); n != 0 {
+		t.Errorf("%d connections, disconnections or subscriptions of the MQTT client while reopening the serial port", n)
+	}
+}
+
+/**
+ * At startup, the serial port is opened again while the permission is denied, until it is granted
+ */
+func TestOpenSerialPortPermissionRetry(t *testing.T) {
+	setupConfig(t, "", map[string]interface{}{"rfplayer.reopeninterval": 0})
+
+	f, err := os.CreateTemp(t.TempDir(), "ttyRFP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if err := os.Chmod(f.Name(), 0); err != nil {
+		t.Fatal(err)
+	}
+	if file, err := os.OpenFile(f.Name(), os.O_RDWR, 0); err == nil {
+		file.Close()
+		t.Skip("permission not denied on a file of mode 000, running as root")
+	}
+
+	saved := rfpConfig
+	rfpConfig.PortName = f.Name()
+	t.Cleanup(func() { rfpConfig = saved })
+
+	var granted int32
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		atomic.StoreInt32(&granted, 1)
+		os.Chmod(f.Name(), 0600)
+	}()
+
+	p, err := openSerialPort()
+	if atomic.LoadInt32(&granted) == 0 {
+		t.Fatalf("openSerialPort returned before the permission was granted: %v", err)
+	}
+	if p != nil {
+		p.Close()
+	}
+	// The temp file is not a tty, the termios setup fails once the file is opened
+	if os.IsPermission(err) {
+		t.Errorf("permission error %v returned once granted", err)
+	}
+}
+
+/**
+ * The aliases of a sensor are published with the mqtt sink, but not in a batch only
+ */
+func TestReadingTopicsAliases(t *testing.T) {
+	yaml := "sensors:\n  - id: 4-13369345\n    topic: maison/salon\n    topics: [ rfp2mqtt/salon ]\n"
+	tests := []struct {
+		name    string
+		options map[string]interface{}
+		topics  []string
+	}{
+		{"mqtt", nil, []string{"maison/salon", "rfp2mqtt/salon"}},
+		{"stdout", map[string]interface{}{"sink.type": "stdout"}, []string{"maison/salon"}},
+		{"batch", map[string]interface{}{"brockermqtt.batchwindow": 5}, []string{"maison/salon"}},
+		{"batchkeeptopics", map[string]interface{}{"brockermqtt.batchwindow": 5, "brockermqtt.batchkeeptopics": true}, []string{"maison/salon", "rfp2mqtt/salon"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupConfig(t, yaml, tt.options)
+
+			if topics := readingTopics("maison/salon", "4-13369345"); !reflect.DeepEqual(topics, tt.topics) {
+				t.Errorf("topics %v, expected %v", topics, tt.topics)
+			}
+		})
+	}
+}
+
+/**
+ * With brockermqtt.asciitopics, the topic and the aliases of a sensor are transliterated, its publish options found by them
+ */
+func TestReadingOptionsASCIITopics(t *testing.T) {
+	yaml := "sensors:\n  - id: 4-13369345\n    name: Chambre Bébé\n    topics: [ maison/Chambre Bébé ]\n    class: critical\n"
+	setupConfig(t, yaml, map[string]interface{}{"brockermqtt.asciitopics": true})
+
+	m := testFrame(infosType4, receivedProtocolOREGON, 0x1A2D, 0x00CC, 1, 0, 215, 48)
+	r, ok := decodeFrame(len(m), m)
+	if !ok || r.Topic != "Chambre Bebe" {
+		t.Fatalf("reading published on %q, expected Chambre Bebe", r.Topic)
+	}
+	topics := readingTopics(r.Topic, r.Sensor.Ref)
+	if expected := []string{"Chambre Bebe", "maison/Chambre Bebe"}; !reflect.DeepEqual(topics, expected) {
+		t.Errorf("topics %v, expected %v", topics, expected)
+	}
+	for _, topic := range topics {
+		if options := readingOptions(topic); options != sensorClasses["critical"] {
+			t.Errorf("options %+v of %s, expected those of the critical class", options, topic)
+		}
+	}
+}
+
+/**
+ * The totals of a TIC counter crossing the 32 bits boundary, confirmed or not by the next frame
+ */
+func TestTICCounterTotal(t *testing.T) {
+	type step struct {
+		v        uint32
+		total    uint64
+		rollover bool
+	}
+	tests := map[string][]step{
+		"confirmed": {
+			{0xFFFFFF00, 0xFFFFFF00, false},
+			{0x00000100, 0xFFFFFF00, false}, // To be confirmed, the last total is kept
+			{0x00000200, 1<<32 + 0x200, true},
+			{0x00000300, 1<<32 + 0x300, false},
+		},
+		"corrupted": {
+			{0xFFFFFF00, 0xFFFFFF00, false},
+			{0x00000010, 0xFFFFFF00, false},
+			{0xFFFFFF10, 0xFFFFFF10, false},
+		},
+	}
+
+	for name, steps := range tests {
+		t.Run(name, func(t *testing.T) {
+			setupConfig(t, "", nil)
+
+			for i, s := range steps {
+				total, rollover := ticCounterTotal("13-1", "cnt1", s.v)
+				if total != s.total || rollover != s.rollover {
+					t.Errorf("frame %d, %#x: total %#x rollover %t, expected %#x %t", i, s.v, total, rollover, s.total, s.rollover)
+				}
+			}
+		})
+	}
+}
+
+/**
+ * With brockermqtt.ticcountersfile, the totals survive a restart
+ */
+func TestTICCountersFile(t *testing.T) {
+	path := t.TempDir() + "/tic.gob"
+	setupConfig(t, "", map[string]interface{}{"brockermqtt.ticcountersfile": path})
+
+	ticCounterTotal("13-1", "cnt1", 0xFFFFFF00)
+	ticCounterTotal("13-1", "cnt1", 0x00000100)
+	ticCounterTotal("13-1", "cnt1", 0x00000200)
+
+	createReadingsCaches() // Restart, the counters are read from the file
+	if total, _ := ticCounterTotal("13-1", "cnt1", 0x00000300); total != 1<<32+0x300 {
+		t.Errorf("total %#x after restart, expected %#x", total, uint64(1<<32+0x300))
+	}
+}
+
+/**
+ * Every field of the readings, optional ones included, is described in the JSON schema
+ */
+func TestSchemaDescribesReadings(t *testing.T) {
+	setupConfig(t, "", map[string]interface{}{
+		"brockermqtt.includerfmetrics": true,
+		"brockermqtt.allqualifierbits": true,
+		"brockermqtt.includeidhex":     true,
+		"brockermqtt.includehash":      true,
+	})
+
+	words := []uint16{1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1}
+	frames := [][]byte{testFrame(42, 0, words...)}
+	for infosType := range infosTypeMinLength {
+		frames = append(frames, testFrame(infosType, 0, words...))
+	}
+
+	for _, m := range frames {
+		_, fields := decodeTestFrame(t, m)
+		for k := range fields {
+			if _, found := payloadSchemaFields[k]; !found {
+				t.Errorf("field %s of infosType %d not described in the schema", k, m[12])
+			}
+		}
+	}
+}
+
+/**
+ * The state of a commanded actuator is confirmed by its sensor even when the reading is dropped by brockermqtt.changeonly
+ */
+func TestDecodeConfirmUnchangedState(t *testing.T) {
+	setupConfig(t, "", map[string]interface{}{"brockermqtt.changeonly": true})
+
+	m := testFrame(infosType1, receivedProtocolCHACON, 1, 0x5678, 0x0012)
+	if _, ok := decodeFrame(len(m), m); !ok {
+		t.Fatalf("first reading not published")
+	}
+
+	pendingConfirmsCache.Set("1-1201784", "lampe", time.Minute)
+	if _, ok := decodeFrame(len(m), m); ok {
+		t.Errorf("unchanged reading published")
+	}
+	if _, pending := pendingConfirmsCache.Get("1-1201784"); pending {
+		t.Errorf("state of the actuator not confirmed")
+	}
+}
+
+/**
+ * The RF level is only exposed for the sensors of the config, not for each ref heard around
+ */
+func TestRFLevelConfiguredSensors(t *testing.T) {
+	setupConfig(t, "sensors:\n  - id: 4-13369345\n    name: salon\n", nil)
+
+	for _, channel := range []uint16{0x00CC, 0x00CD, 0x00CE} {
+		m := testFrame(infosType4, receivedProtocolOREGON, 0x1A2D, channel, 1, 0, 215, 48)
+		decodeFrame(len(m), m)
+	}
+	if n := testutil.CollectAndCount(metricRFLevel); n != 1 {
+		t.Errorf("%d RF level series, expected 1", n)
+	}
+}